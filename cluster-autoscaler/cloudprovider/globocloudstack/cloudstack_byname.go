@@ -0,0 +1,201 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+)
+
+// nameResolverClient is the subset of cloudstackClient byNameResolver needs
+// to look up a project, zone, service offering or template by its
+// human-readable name rather than the UUID CloudStack actually assigns it.
+type nameResolverClient interface {
+	ListProjects(*cloudstack.ListProjectsParams) (*cloudstack.ListProjectsResponse, error)
+	ListZones(*cloudstack.ListZonesParams) (*cloudstack.ListZonesResponse, error)
+	ListServiceOfferings(*cloudstack.ListServiceOfferingsParams) (*cloudstack.ListServiceOfferingsResponse, error)
+	ListTemplates(*cloudstack.ListTemplatesParams) (*cloudstack.ListTemplatesResponse, error)
+}
+
+// byNameResolver turns the autoScaleProfileMetadata*Name metadata keys on a
+// vmProfile into the UUIDs an AutoScaleVmProfile actually requires, following
+// the retrieveUUID/setValueOrID pattern from the CloudStack Terraform
+// provider: a name is resolved to an ID at most once per process and
+// memoized after that, so repeated Refresh calls for the same node group
+// don't re-issue the same List call. A name is assumed not to be reassigned
+// to a different resource during the manager's lifetime; an operator who
+// renames/recreates a project, zone, offering or template referenced this
+// way needs to restart the autoscaler to pick up the new ID.
+type byNameResolver struct {
+	client nameResolverClient
+
+	mu        sync.Mutex
+	projects  map[string]string
+	zones     map[string]string
+	offerings map[string]string
+	templates map[string]string
+}
+
+func newByNameResolver(client nameResolverClient) *byNameResolver {
+	return &byNameResolver{client: client}
+}
+
+// resolve fills in any of p.asp's Projectid/Zoneid/Serviceofferingid/Templateid
+// that are blank, from the matching autoScaleProfileMetadata*Name metadata
+// key on p, if one is set. A field that's already populated - the ASP was
+// given a UUID directly, the usual case - is left untouched, so by-name
+// metadata only ever fills a gap rather than overriding an explicit ID.
+func (r *byNameResolver) resolve(p *vmProfile) error {
+	if p.asp.Projectid == "" {
+		if name := p.aspMetadata[autoScaleProfileMetadataProjectName]; name != "" {
+			id, err := r.resolveProject(name)
+			if err != nil {
+				return err
+			}
+			p.asp.Projectid = id
+		}
+	}
+	if p.asp.Zoneid == "" {
+		if name := p.aspMetadata[autoScaleProfileMetadataZoneName]; name != "" {
+			id, err := r.resolveZone(name)
+			if err != nil {
+				return err
+			}
+			p.asp.Zoneid = id
+		}
+	}
+	if p.asp.Serviceofferingid == "" {
+		if name := p.aspMetadata[autoScaleProfileMetadataServiceOfferingName]; name != "" {
+			id, err := r.resolveServiceOffering(name)
+			if err != nil {
+				return err
+			}
+			p.asp.Serviceofferingid = id
+		}
+	}
+	if p.asp.Templateid == "" {
+		if name := p.aspMetadata[autoScaleProfileMetadataTemplateName]; name != "" {
+			id, err := r.resolveTemplate(name)
+			if err != nil {
+				return err
+			}
+			p.asp.Templateid = id
+		}
+	}
+	return nil
+}
+
+// resolveCached serves name's ID for a given resource kind out of cache,
+// falling back to lookup and memoizing the result on a miss.
+func (r *byNameResolver) resolveCached(cache *map[string]string, name string, lookup func(name string) (string, error)) (string, error) {
+	r.mu.Lock()
+	if id, ok := (*cache)[name]; ok {
+		r.mu.Unlock()
+		return id, nil
+	}
+	r.mu.Unlock()
+
+	id, err := lookup(name)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	if *cache == nil {
+		*cache = map[string]string{}
+	}
+	(*cache)[name] = id
+	r.mu.Unlock()
+	return id, nil
+}
+
+func (r *byNameResolver) resolveProject(name string) (string, error) {
+	return r.resolveCached(&r.projects, name, func(name string) (string, error) {
+		var params cloudstack.ListProjectsParams
+		params.SetName(name)
+		resp, err := r.client.ListProjects(&params)
+		if err != nil {
+			return "", fmt.Errorf("listing projects named %q: %w", name, err)
+		}
+		if len(resp.Projects) == 0 {
+			return "", fmt.Errorf("no project named %q", name)
+		}
+		return resp.Projects[0].Id, nil
+	})
+}
+
+func (r *byNameResolver) resolveZone(name string) (string, error) {
+	return r.resolveCached(&r.zones, name, func(name string) (string, error) {
+		var params cloudstack.ListZonesParams
+		params.SetName(name)
+		resp, err := r.client.ListZones(&params)
+		if err != nil {
+			return "", fmt.Errorf("listing zones named %q: %w", name, err)
+		}
+		if len(resp.Zones) == 0 {
+			return "", fmt.Errorf("no zone named %q", name)
+		}
+		return resp.Zones[0].Id, nil
+	})
+}
+
+// resolveZones resolves each of names to a zone ID, in the same order,
+// using the same per-name memoized cache as resolveZone.
+func (r *byNameResolver) resolveZones(names []string) ([]string, error) {
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		id, err := r.resolveZone(name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (r *byNameResolver) resolveServiceOffering(name string) (string, error) {
+	return r.resolveCached(&r.offerings, name, func(name string) (string, error) {
+		var params cloudstack.ListServiceOfferingsParams
+		params.SetName(name)
+		resp, err := r.client.ListServiceOfferings(&params)
+		if err != nil {
+			return "", fmt.Errorf("listing service offerings named %q: %w", name, err)
+		}
+		if len(resp.ServiceOfferings) == 0 {
+			return "", fmt.Errorf("no service offering named %q", name)
+		}
+		return resp.ServiceOfferings[0].Id, nil
+	})
+}
+
+func (r *byNameResolver) resolveTemplate(name string) (string, error) {
+	return r.resolveCached(&r.templates, name, func(name string) (string, error) {
+		var params cloudstack.ListTemplatesParams
+		params.SetName(name)
+		params.SetTemplatefilter(templateFilterExecutable)
+		resp, err := r.client.ListTemplates(&params)
+		if err != nil {
+			return "", fmt.Errorf("listing templates named %q: %w", name, err)
+		}
+		if len(resp.Templates) == 0 {
+			return "", fmt.Errorf("no executable template named %q", name)
+		}
+		return resp.Templates[0].Id, nil
+	})
+}
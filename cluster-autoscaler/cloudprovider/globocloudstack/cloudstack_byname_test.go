@@ -0,0 +1,133 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+)
+
+func Test_byNameResolver_resolve(t *testing.T) {
+	cli := &fakeClient{}
+
+	projectParams := cloudstack.ListProjectsParams{}
+	projectParams.SetName("myproject")
+	cli.On("ListProjects", &projectParams).Return(&cloudstack.ListProjectsResponse{
+		Projects: []*cloudstack.Project{{Id: "pj1"}},
+	}, nil)
+
+	zoneParams := cloudstack.ListZonesParams{}
+	zoneParams.SetName("myzone")
+	cli.On("ListZones", &zoneParams).Return(&cloudstack.ListZonesResponse{
+		Zones: []*cloudstack.Zone{{Id: "zone1"}},
+	}, nil)
+
+	offeringParams := cloudstack.ListServiceOfferingsParams{}
+	offeringParams.SetName("myoffering")
+	cli.On("ListServiceOfferings", &offeringParams).Return(&cloudstack.ListServiceOfferingsResponse{
+		ServiceOfferings: []*cloudstack.ServiceOffering{{Id: "offering1"}},
+	}, nil)
+
+	templateParams := cloudstack.ListTemplatesParams{}
+	templateParams.SetName("mytemplate")
+	templateParams.SetTemplatefilter(templateFilterExecutable)
+	cli.On("ListTemplates", &templateParams).Return(&cloudstack.ListTemplatesResponse{
+		Templates: []*cloudstack.Template{{Id: "template1"}},
+	}, nil)
+
+	r := newByNameResolver(cli)
+	p := vmProfile{
+		aspMetadata: map[string]string{
+			autoScaleProfileMetadataProjectName:         "myproject",
+			autoScaleProfileMetadataZoneName:            "myzone",
+			autoScaleProfileMetadataServiceOfferingName: "myoffering",
+			autoScaleProfileMetadataTemplateName:        "mytemplate",
+		},
+	}
+
+	require.NoError(t, r.resolve(&p))
+	assert.Equal(t, "pj1", p.asp.Projectid)
+	assert.Equal(t, "zone1", p.asp.Zoneid)
+	assert.Equal(t, "offering1", p.asp.Serviceofferingid)
+	assert.Equal(t, "template1", p.asp.Templateid)
+
+	// A second resolve against the same names must not re-issue any of the
+	// List calls above. The expectations above set no Times() limit, so
+	// the call count of each is asserted directly.
+	require.NoError(t, r.resolve(&p))
+	cli.AssertNumberOfCalls(t, "ListProjects", 1)
+	cli.AssertNumberOfCalls(t, "ListZones", 1)
+	cli.AssertNumberOfCalls(t, "ListServiceOfferings", 1)
+	cli.AssertNumberOfCalls(t, "ListTemplates", 1)
+}
+
+func Test_byNameResolver_resolve_leavesExplicitIDsUntouched(t *testing.T) {
+	cli := &fakeClient{}
+	r := newByNameResolver(cli)
+
+	p := vmProfile{
+		asp: cloudstack.AutoScaleVmProfile{
+			Projectid:         "pj1",
+			Zoneid:            "zone1",
+			Serviceofferingid: "offering1",
+			Templateid:        "template1",
+		},
+		aspMetadata: map[string]string{
+			autoScaleProfileMetadataProjectName:         "myproject",
+			autoScaleProfileMetadataZoneName:            "myzone",
+			autoScaleProfileMetadataServiceOfferingName: "myoffering",
+			autoScaleProfileMetadataTemplateName:        "mytemplate",
+		},
+	}
+
+	require.NoError(t, r.resolve(&p))
+	assert.Equal(t, "pj1", p.asp.Projectid)
+	assert.Equal(t, "zone1", p.asp.Zoneid)
+	assert.Equal(t, "offering1", p.asp.Serviceofferingid)
+	assert.Equal(t, "template1", p.asp.Templateid)
+	cli.AssertNotCalled(t, "ListProjects", mock.Anything)
+	cli.AssertNotCalled(t, "ListZones", mock.Anything)
+	cli.AssertNotCalled(t, "ListServiceOfferings", mock.Anything)
+	cli.AssertNotCalled(t, "ListTemplates", mock.Anything)
+}
+
+func Test_byNameResolver_resolve_noNameMetadataIsANoop(t *testing.T) {
+	cli := &fakeClient{}
+	r := newByNameResolver(cli)
+
+	p := vmProfile{}
+	require.NoError(t, r.resolve(&p))
+	assert.Empty(t, p.asp.Projectid)
+	assert.Empty(t, p.asp.Zoneid)
+	assert.Empty(t, p.asp.Serviceofferingid)
+	assert.Empty(t, p.asp.Templateid)
+}
+
+func Test_byNameResolver_resolveProject_notFound(t *testing.T) {
+	cli := &fakeClient{}
+	params := cloudstack.ListProjectsParams{}
+	params.SetName("missing")
+	cli.On("ListProjects", &params).Return(&cloudstack.ListProjectsResponse{}, nil)
+
+	r := newByNameResolver(cli)
+	_, err := r.resolveProject("missing")
+	assert.EqualError(t, err, `no project named "missing"`)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	klog "k8s.io/klog/v2"
+)
+
+// minNativeAutoScaleVersion is the CloudStack version at which
+// AutoScaleVmGroup gained first-class counter/condition/policy support,
+// making it viable to drive a node group's scale and membership through a
+// native AutoScaleVmGroup instead of this package's existing mode:
+// deploying/destroying VMs directly around an AutoScaleVmProfile, with its
+// own pendingVM tracking, disruption budgets and drift replacement.
+//
+// This file only detects that version; it does NOT implement the native
+// mode. Switching scaleUp/DeleteNodes/drift replacement over to it is a
+// separate, substantially larger change - it touches the entire
+// node-lifecycle surface and depends on the real go-cloudstack v2
+// AutoScaleVmGroup API shape, which isn't available to verify against in
+// this environment. nativeAutoScaleSupported only feeds the
+// nativeAutoScaleSupportedGauge below and a V(4) log line in
+// cloudstackManager.Refresh, so operators can tell which of
+// their CloudStack deployments are even eligible before that follow-up work
+// is scoped.
+var minNativeAutoScaleVersion = cloudstackVersion{major: 4, minor: 19}
+
+// nativeAutoScaleSupportedGauge reports, per capabilityCheck resolution,
+// whether the connected CloudStack deployment is new enough for the native
+// AutoScaleVmGroup mode (see minNativeAutoScaleVersion) - 1 if so, 0
+// otherwise. cloudstackManager doesn't act on this yet; it exists so
+// operators can see how many of their deployments would already be
+// eligible, ahead of that mode actually being implemented.
+var nativeAutoScaleSupportedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "cloudstack_native_autoscale_supported",
+	Help: "1 if the connected CloudStack deployment's version supports the native AutoScaleVmGroup scaling mode, 0 otherwise. This mode is detected but not yet used to scale node groups.",
+})
+
+type cloudstackVersion struct {
+	major, minor, patch int
+}
+
+func (v cloudstackVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+// atLeast reports whether v is the same as, or newer than, other, comparing
+// major, then minor, then patch.
+func (v cloudstackVersion) atLeast(other cloudstackVersion) bool {
+	if v.major != other.major {
+		return v.major > other.major
+	}
+	if v.minor != other.minor {
+		return v.minor > other.minor
+	}
+	return v.patch >= other.patch
+}
+
+// parseCloudstackVersion parses a CloudStack version string as reported by
+// listCapabilities' cloudstackversion field (e.g. "4.19.0.0" or "4.18.1"),
+// ignoring anything past the first three dot-separated components.
+func parseCloudstackVersion(raw string) (cloudstackVersion, error) {
+	parts := strings.SplitN(raw, ".", 4)
+	if len(parts) < 2 {
+		return cloudstackVersion{}, fmt.Errorf("unparseable cloudstack version %q", raw)
+	}
+
+	var v cloudstackVersion
+	var err error
+	if v.major, err = strconv.Atoi(parts[0]); err != nil {
+		return cloudstackVersion{}, fmt.Errorf("unparseable cloudstack version %q: %w", raw, err)
+	}
+	if v.minor, err = strconv.Atoi(parts[1]); err != nil {
+		return cloudstackVersion{}, fmt.Errorf("unparseable cloudstack version %q: %w", raw, err)
+	}
+	if len(parts) >= 3 {
+		// A trailing patch component that doesn't parse - seen on some
+		// distributions' version strings - doesn't invalidate the
+		// major.minor already read above; it's just treated as 0.
+		v.patch, _ = strconv.Atoi(parts[2])
+	}
+	return v, nil
+}
+
+// capabilitiesClient is the subset of cloudstackClient capabilityCheck needs
+// to detect the connected CloudStack deployment's version.
+type capabilitiesClient interface {
+	ListCapabilities(*cloudstack.ListCapabilitiesParams) (*cloudstack.ListCapabilitiesResponse, error)
+}
+
+// capabilityCheck resolves, at most once, whether the connected CloudStack
+// deployment is new enough to support the native AutoScaleVmGroup mode (see
+// minNativeAutoScaleVersion). A failed listCapabilities call is logged and
+// treated as unsupported, so a transient API error never blocks Refresh -
+// it just keeps the manager on its existing, metadata-driven mode. Nothing
+// in cloudstackManager switches modes based on this yet - see
+// minNativeAutoScaleVersion's doc comment.
+type capabilityCheck struct {
+	client capabilitiesClient
+
+	once       sync.Once
+	native     bool
+	resolveErr error
+}
+
+func newCapabilityCheck(client capabilitiesClient) *capabilityCheck {
+	return &capabilityCheck{client: client}
+}
+
+// nativeAutoScaleSupported reports whether the connected CloudStack
+// deployment's version is minNativeAutoScaleVersion or newer.
+func (c *capabilityCheck) nativeAutoScaleSupported() bool {
+	if c == nil {
+		return false
+	}
+	c.once.Do(func() {
+		var params cloudstack.ListCapabilitiesParams
+		resp, err := c.client.ListCapabilities(&params)
+		if err != nil {
+			c.resolveErr = fmt.Errorf("listing capabilities: %w", err)
+			return
+		}
+		if resp.Capabilities == nil {
+			c.resolveErr = fmt.Errorf("listCapabilities returned no capabilities")
+			return
+		}
+		version, err := parseCloudstackVersion(resp.Capabilities.Cloudstackversion)
+		if err != nil {
+			c.resolveErr = err
+			return
+		}
+		c.native = version.atLeast(minNativeAutoScaleVersion)
+		if c.native {
+			nativeAutoScaleSupportedGauge.Set(1)
+		} else {
+			nativeAutoScaleSupportedGauge.Set(0)
+		}
+	})
+	if c.resolveErr != nil {
+		klog.Warningf("detecting cloudstack version for native autoscale support, falling back to metadata-driven mode: %v", c.resolveErr)
+	}
+	return c.native
+}
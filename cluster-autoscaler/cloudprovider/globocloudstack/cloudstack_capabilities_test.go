@@ -0,0 +1,100 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+)
+
+func Test_parseCloudstackVersion(t *testing.T) {
+	tests := map[string]cloudstackVersion{
+		"4.19.0.0": {major: 4, minor: 19, patch: 0},
+		"4.19.1":   {major: 4, minor: 19, patch: 1},
+		"4.18":     {major: 4, minor: 18, patch: 0},
+	}
+	for raw, want := range tests {
+		t.Run(raw, func(t *testing.T) {
+			got, err := parseCloudstackVersion(raw)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func Test_parseCloudstackVersion_unparseable(t *testing.T) {
+	_, err := parseCloudstackVersion("not-a-version")
+	assert.Error(t, err)
+}
+
+func Test_cloudstackVersion_atLeast(t *testing.T) {
+	tests := []struct {
+		v, other cloudstackVersion
+		want     bool
+	}{
+		{cloudstackVersion{4, 19, 0}, cloudstackVersion{4, 19, 0}, true},
+		{cloudstackVersion{4, 20, 0}, cloudstackVersion{4, 19, 0}, true},
+		{cloudstackVersion{4, 18, 9}, cloudstackVersion{4, 19, 0}, false},
+		{cloudstackVersion{5, 0, 0}, cloudstackVersion{4, 19, 0}, true},
+		{cloudstackVersion{4, 19, 0}, cloudstackVersion{4, 19, 1}, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.v.atLeast(tt.other), "%s.atLeast(%s)", tt.v, tt.other)
+	}
+}
+
+func Test_capabilityCheck_nativeAutoScaleSupported(t *testing.T) {
+	cli := &fakeClient{}
+	cli.On("ListCapabilities", mock.Anything).Return(&cloudstack.ListCapabilitiesResponse{
+		Capabilities: &cloudstack.Capabilities{Cloudstackversion: "4.19.0.0"},
+	}, nil)
+
+	c := newCapabilityCheck(cli)
+	assert.True(t, c.nativeAutoScaleSupported())
+	cli.AssertNumberOfCalls(t, "ListCapabilities", 1)
+
+	// A second call must not re-issue ListCapabilities.
+	assert.True(t, c.nativeAutoScaleSupported())
+	cli.AssertNumberOfCalls(t, "ListCapabilities", 1)
+}
+
+func Test_capabilityCheck_nativeAutoScaleSupported_olderVersion(t *testing.T) {
+	cli := &fakeClient{}
+	cli.On("ListCapabilities", mock.Anything).Return(&cloudstack.ListCapabilitiesResponse{
+		Capabilities: &cloudstack.Capabilities{Cloudstackversion: "4.18.1.0"},
+	}, nil)
+
+	c := newCapabilityCheck(cli)
+	assert.False(t, c.nativeAutoScaleSupported())
+}
+
+func Test_capabilityCheck_nativeAutoScaleSupported_apiErrorFallsBack(t *testing.T) {
+	cli := &fakeClient{}
+	cli.On("ListCapabilities", mock.Anything).Return((*cloudstack.ListCapabilitiesResponse)(nil), assert.AnError)
+
+	c := newCapabilityCheck(cli)
+	assert.False(t, c.nativeAutoScaleSupported())
+}
+
+func Test_capabilityCheck_nativeAutoScaleSupported_nilCheckFallsBack(t *testing.T) {
+	var c *capabilityCheck
+	assert.False(t, c.nativeAutoScaleSupported())
+}
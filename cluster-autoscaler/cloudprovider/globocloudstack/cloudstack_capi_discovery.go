@@ -0,0 +1,250 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+	klog "k8s.io/klog/v2"
+)
+
+const autoDiscovererTypeCAPI = "capi"
+
+// We talk to the Cluster API CloudStack CRDs through the dynamic client and
+// unstructured objects, the same way crdDiscoverer talks to our own
+// CloudstackNodeGroup CRD, rather than vendoring
+// sigs.k8s.io/cluster-api-provider-cloudstack just for its types.
+var (
+	machineDeploymentGVR = schema.GroupVersionResource{
+		Group:    "cluster.x-k8s.io",
+		Version:  "v1beta1",
+		Resource: "machinedeployments",
+	}
+	cloudStackMachineTemplateGVR = schema.GroupVersionResource{
+		Group:    "infrastructure.cluster.x-k8s.io",
+		Version:  "v1beta3",
+		Resource: "cloudstackmachinetemplates",
+	}
+)
+
+const (
+	capiClusterNameLabel  = "cluster.x-k8s.io/cluster-name"
+	capiMinSizeAnnotation = "cluster.x-k8s.io/cluster-api-autoscaler-node-group-min-size"
+	capiMaxSizeAnnotation = "cluster.x-k8s.io/cluster-api-autoscaler-node-group-max-size"
+
+	// capiZonesAnnotation is the same key as autoScaleProfileMetadataZones,
+	// required on every autoscaled MachineDeployment since a
+	// CloudStackMachineTemplate has no zone field of its own to read one
+	// from. See machineDeploymentMetadata.
+	capiZonesAnnotation = autoScaleProfileMetadataZones
+)
+
+// capiAutoDiscoveryConfig configures a capiDiscoverer: it watches
+// MachineDeployments in Namespace that belong to ClusterName.
+type capiAutoDiscoveryConfig struct {
+	Namespace   string
+	ClusterName string
+}
+
+// capiDiscoverer discovers node groups from Cluster API CloudStack
+// MachineDeployments instead of from AutoScaleVmProfile resources, so
+// operators running CAPI-managed CloudStack clusters don't also have to
+// configure the CloudStack AutoScale service. Each MachineDeployment's
+// referenced CloudStackMachineTemplate is translated into a discoveredASP so
+// it flows through the same Refresh/pricing/TemplateNodeInfo machinery as
+// every other node group.
+//
+// Every discovered group is stamped managedExternallyByCAPI (see
+// autoScaleProfileMetadataManagedExternallyBy): teaching csNodeGroup to
+// scale a CAPI-discovered group by setting MachineDeployment.Spec.Replicas,
+// instead of deploying/destroying CloudStack VMs directly through csScaler,
+// is tracked as follow-up work, since it needs a second
+// IncreaseSize/DeleteNodes implementation. Until then, IncreaseSize and
+// DeleteNodes refuse to run against a CAPI-discovered group rather than
+// fighting the MachineSet controller's own reconciliation over VMs it
+// doesn't know the autoscaler touched.
+type capiDiscoverer struct {
+	manager     *cloudstackManager
+	namespace   string
+	clusterName string
+	client      dynamic.Interface
+}
+
+func newCAPIDiscoverer(m *cloudstackManager, cfg capiAutoDiscoveryConfig, client dynamic.Interface) *capiDiscoverer {
+	return &capiDiscoverer{manager: m, namespace: cfg.Namespace, clusterName: cfg.ClusterName, client: client}
+}
+
+func (d *capiDiscoverer) Discover() ([]discoveredASP, error) {
+	ctx := context.Background()
+
+	deployments, err := d.client.Resource(machineDeploymentGVR).Namespace(d.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: capiClusterNameLabel + "=" + d.clusterName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing MachineDeployments in namespace %q: %w", d.namespace, err)
+	}
+
+	var found []discoveredASP
+	for _, md := range deployments.Items {
+		metadata, templateRef, ok := d.machineDeploymentMetadata(md)
+		if !ok {
+			continue
+		}
+
+		asp, err := d.aspFromMachineTemplate(ctx, templateRef)
+		if err != nil {
+			return nil, err
+		}
+
+		found = append(found, discoveredASP{asp: asp, metadata: metadata})
+	}
+	return found, nil
+}
+
+// machineDeploymentMetadata extracts the autoscaler-facing metadata
+// (nodeGroupName/min/max/zones) from a MachineDeployment, and the name of
+// the CloudStackMachineTemplate its InfrastructureRef points at. It returns
+// ok=false for MachineDeployments missing the size annotations, since those
+// aren't meant to be autoscaled.
+//
+// A CloudStackMachineTemplate carries no zone of its own (zones live on the
+// CloudStackCluster's failure domains instead), so unlike
+// offering/template/diskOffering below, a CAPI-discovered profile can't
+// resolve its asp.Zoneid from the template. It is instead required to carry
+// the same capiZonesAnnotation autoscaler-facing annotation that feeds
+// autoScaleProfileMetadataZones for every other discoverer, so
+// resolveNodeGroupZones resolves it the usual way. A MachineDeployment
+// missing it is skipped rather than discovered with an empty Zoneid, which
+// would otherwise break Refresh for every node group the first time
+// GetZoneByID("") is called.
+func (d *capiDiscoverer) machineDeploymentMetadata(md unstructured.Unstructured) (map[string]string, string, bool) {
+	annotations := md.GetAnnotations()
+	min, hasMin := annotations[capiMinSizeAnnotation]
+	max, hasMax := annotations[capiMaxSizeAnnotation]
+	if !hasMin || !hasMax {
+		return nil, "", false
+	}
+	if _, err := strconv.Atoi(min); err != nil {
+		return nil, "", false
+	}
+	if _, err := strconv.Atoi(max); err != nil {
+		return nil, "", false
+	}
+
+	zones := annotations[capiZonesAnnotation]
+	if zones == "" {
+		klog.Warningf("MachineDeployment %q/%q has no %q annotation, skipping: a CAPI-discovered node group must declare its zone(s) that way", md.GetNamespace(), md.GetName(), capiZonesAnnotation)
+		return nil, "", false
+	}
+
+	templateName, _, _ := unstructured.NestedString(md.Object, "spec", "template", "spec", "infrastructureRef", "name")
+	if templateName == "" {
+		return nil, "", false
+	}
+
+	metadata := map[string]string{
+		autoScaleProfileMetadataName:                md.GetName(),
+		autoScaleProfileMetadataMin:                 min,
+		autoScaleProfileMetadataMax:                 max,
+		autoScaleProfileMetadataZones:               zones,
+		autoScaleProfileMetadataManagedExternallyBy: managedExternallyByCAPI,
+	}
+	return metadata, templateName, true
+}
+
+// aspFromMachineTemplate fetches the CloudStackMachineTemplate named
+// templateName and maps its spec onto the subset of AutoScaleVmProfile
+// fields the rest of the manager (pricing, TemplateNodeInfo, drift
+// detection) already understands.
+func (d *capiDiscoverer) aspFromMachineTemplate(ctx context.Context, templateName string) (cloudstack.AutoScaleVmProfile, error) {
+	tmpl, err := d.client.Resource(cloudStackMachineTemplateGVR).Namespace(d.namespace).Get(ctx, templateName, metav1.GetOptions{})
+	if err != nil {
+		return cloudstack.AutoScaleVmProfile{}, fmt.Errorf("getting CloudStackMachineTemplate %q: %w", templateName, err)
+	}
+
+	spec, _, _ := unstructured.NestedMap(tmpl.Object, "spec", "template", "spec")
+	offeringID, _, _ := unstructured.NestedString(spec, "offering", "id")
+	templateID, _, _ := unstructured.NestedString(spec, "template", "id")
+	diskOfferingID, _, _ := unstructured.NestedString(spec, "diskOffering", "id")
+	affinityGroupIDs, _, _ := unstructured.NestedStringSlice(spec, "affinityGroupIDs")
+
+	params := make([]string, 0, len(affinityGroupIDs)+1)
+	if diskOfferingID != "" {
+		params = append(params, "diskofferingid="+diskOfferingID)
+	}
+	if len(affinityGroupIDs) > 0 {
+		params = append(params, "affinitygroupids="+strings.Join(affinityGroupIDs, ","))
+	}
+
+	return cloudstack.AutoScaleVmProfile{
+		Serviceofferingid: offeringID,
+		Templateid:        templateID,
+		Otherdeployparams: strings.Join(params, "&"),
+	}, nil
+}
+
+func parseCAPIAutoDiscoverySpec(args string) (capiAutoDiscoveryConfig, error) {
+	cfg := capiAutoDiscoveryConfig{}
+	for _, arg := range strings.Split(args, ",") {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return cfg, fmt.Errorf("invalid key=value pair %s", arg)
+		}
+		switch kv[0] {
+		case "namespace":
+			cfg.Namespace = kv[1]
+		case "clusterName":
+			cfg.ClusterName = kv[1]
+		default:
+			return cfg, fmt.Errorf("unsupported capi discoverer option: %s", kv[0])
+		}
+	}
+	if cfg.Namespace == "" {
+		return cfg, fmt.Errorf("capi discoverer requires a namespace, e.g. capi:namespace=kube-system,clusterName=mycluster")
+	}
+	if cfg.ClusterName == "" {
+		return cfg, fmt.Errorf("capi discoverer requires a clusterName, e.g. capi:namespace=kube-system,clusterName=mycluster")
+	}
+	return cfg, nil
+}
+
+// newManagementClient builds a dynamic client for the Cluster API
+// management cluster from a kubeconfig file, since (unlike every other
+// discoverer) the MachineDeployments/CloudStackMachineTemplates a
+// capiDiscoverer reads usually don't live on the cluster the autoscaler
+// itself runs on.
+func newManagementClient(kubeconfigPath string) (dynamic.Interface, error) {
+	if kubeconfigPath == "" {
+		return nil, fmt.Errorf("a management_kubeconfig is required to use the %q discoverer", autoDiscovererTypeCAPI)
+	}
+
+	cfg, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("building management cluster config from kubeconfig %q: %w", kubeconfigPath, err)
+	}
+
+	return dynamic.NewForConfig(cfg)
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func Test_capiDiscoverer_Discover(t *testing.T) {
+	scheme := runtime.NewScheme()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme, map[schema.GroupVersionResource]string{
+		machineDeploymentGVR:         "MachineDeploymentList",
+		cloudStackMachineTemplateGVR: "CloudStackMachineTemplateList",
+	})
+
+	md := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cluster.x-k8s.io/v1beta1",
+		"kind":       "MachineDeployment",
+		"metadata": map[string]interface{}{
+			"name":      "workers",
+			"namespace": "capi-system",
+			"labels":    map[string]interface{}{capiClusterNameLabel: "mycluster"},
+			"annotations": map[string]interface{}{
+				capiMinSizeAnnotation: "1",
+				capiMaxSizeAnnotation: "5",
+				capiZonesAnnotation:   "zone1",
+			},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"infrastructureRef": map[string]interface{}{"name": "workers-template"},
+				},
+			},
+		},
+	}}
+	tmpl := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "infrastructure.cluster.x-k8s.io/v1beta3",
+		"kind":       "CloudStackMachineTemplate",
+		"metadata": map[string]interface{}{
+			"name":      "workers-template",
+			"namespace": "capi-system",
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"offering": map[string]interface{}{"id": "offering1"},
+					"template": map[string]interface{}{"id": "template1"},
+				},
+			},
+		},
+	}}
+
+	_, err := client.Resource(machineDeploymentGVR).Namespace("capi-system").Create(context.Background(), md, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = client.Resource(cloudStackMachineTemplateGVR).Namespace("capi-system").Create(context.Background(), tmpl, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	d := newCAPIDiscoverer(&cloudstackManager{}, capiAutoDiscoveryConfig{Namespace: "capi-system", ClusterName: "mycluster"}, client)
+
+	found, err := d.Discover()
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "workers", found[0].metadata[autoScaleProfileMetadataName])
+	assert.Equal(t, "1", found[0].metadata[autoScaleProfileMetadataMin])
+	assert.Equal(t, "5", found[0].metadata[autoScaleProfileMetadataMax])
+	assert.Equal(t, "offering1", found[0].asp.Serviceofferingid)
+	assert.Equal(t, "template1", found[0].asp.Templateid)
+	assert.Equal(t, "zone1", found[0].metadata[autoScaleProfileMetadataZones])
+	assert.Equal(t, managedExternallyByCAPI, found[0].metadata[autoScaleProfileMetadataManagedExternallyBy])
+}
+
+// Test_capiDiscoverer_Discover_missingZonesAnnotationIsSkipped confirms a
+// MachineDeployment without capiZonesAnnotation is skipped rather than
+// discovered with an empty asp.Zoneid, since a CloudStackMachineTemplate has
+// no zone field of its own for aspFromMachineTemplate to fall back to.
+func Test_capiDiscoverer_Discover_missingZonesAnnotationIsSkipped(t *testing.T) {
+	scheme := runtime.NewScheme()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme, map[schema.GroupVersionResource]string{
+		machineDeploymentGVR:         "MachineDeploymentList",
+		cloudStackMachineTemplateGVR: "CloudStackMachineTemplateList",
+	})
+
+	md := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cluster.x-k8s.io/v1beta1",
+		"kind":       "MachineDeployment",
+		"metadata": map[string]interface{}{
+			"name":      "workers",
+			"namespace": "capi-system",
+			"labels":    map[string]interface{}{capiClusterNameLabel: "mycluster"},
+			"annotations": map[string]interface{}{
+				capiMinSizeAnnotation: "1",
+				capiMaxSizeAnnotation: "5",
+			},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"infrastructureRef": map[string]interface{}{"name": "workers-template"},
+				},
+			},
+		},
+	}}
+
+	_, err := client.Resource(machineDeploymentGVR).Namespace("capi-system").Create(context.Background(), md, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	d := newCAPIDiscoverer(&cloudstackManager{}, capiAutoDiscoveryConfig{Namespace: "capi-system", ClusterName: "mycluster"}, client)
+
+	found, err := d.Discover()
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"fmt"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeGroupConditionType is modeled on CAPZ's ScaleSet conditions: a node
+// group has one condition per Type, True once it has reached the size it
+// was last asked to reach and False - with Reason/Message explaining why -
+// while a scale operation is in flight or has failed.
+type NodeGroupConditionType string
+
+// NodeGroupDesiredReplicasCondition mirrors CAPZ's
+// ScaleSetDesiredReplicasCondition: True once a node group's VM count
+// matches what IncreaseSize/DeleteNodes last asked for.
+const NodeGroupDesiredReplicasCondition NodeGroupConditionType = "DesiredReplicas"
+
+const (
+	// NodeGroupScalingUpReason is set while IncreaseSize/manager.scaleUp is
+	// creating VMs to reach a higher target size. Mirrors CAPZ's
+	// ScaleSetScaleUpReason.
+	NodeGroupScalingUpReason = "ScalingUp"
+
+	// NodeGroupScalingDownReason is set while DeleteNodes is destroying VMs
+	// to reach a lower target size. Mirrors CAPZ's ScaleSetScaleDownReason.
+	NodeGroupScalingDownReason = "ScalingDown"
+
+	// NodeGroupProvisioningFailedReason is set when manager.scaleUp's
+	// DeployVirtualMachine call failed for at least one VM. Mirrors CAPZ's
+	// ScaleSetProvisionFailedReason.
+	NodeGroupProvisioningFailedReason = "ProvisioningFailed"
+
+	// NodeGroupTaggingFailedReason is set when manager.scaleUp deployed a VM
+	// but failed to tag it (csScaler.createVM destroys the VM again before
+	// this reason is ever observed externally, so it never leaks an
+	// untagged, untracked VM).
+	NodeGroupTaggingFailedReason = "TaggingFailed"
+)
+
+// NodeGroupCondition is a point-in-time observation of a csNodeGroup's
+// progress toward its desired size. See NodeGroupConditionType.
+type NodeGroupCondition struct {
+	Type               NodeGroupConditionType
+	Status             apiv1.ConditionStatus
+	LastTransitionTime metav1.Time
+	Reason             string
+	Message            string
+}
+
+// Conditions returns a snapshot of this node group's NodeGroupConditions, as
+// last set by setCondition.
+func (g *csNodeGroup) Conditions() []NodeGroupCondition {
+	g.conditionsMu.Lock()
+	defer g.conditionsMu.Unlock()
+
+	out := make([]NodeGroupCondition, len(g.conditions))
+	copy(out, g.conditions)
+	return out
+}
+
+// setCondition records a transition on t, replacing any previous condition
+// of the same Type, and mirrors it as a Kubernetes Event via g.manager, so
+// operators can see a stuck or failed scale operation with `kubectl get
+// events` instead of having to dig through autoscaler logs.
+func (g *csNodeGroup) setCondition(t NodeGroupConditionType, status apiv1.ConditionStatus, reason, message string) {
+	cond := NodeGroupCondition{
+		Type:               t,
+		Status:             status,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+
+	g.conditionsMu.Lock()
+	replaced := false
+	for i := range g.conditions {
+		if g.conditions[i].Type == t {
+			g.conditions[i] = cond
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		g.conditions = append(g.conditions, cond)
+	}
+	g.conditionsMu.Unlock()
+
+	eventType := apiv1.EventTypeNormal
+	if status == apiv1.ConditionFalse && (reason == NodeGroupProvisioningFailedReason || reason == NodeGroupTaggingFailedReason) {
+		eventType = apiv1.EventTypeWarning
+	}
+	g.manager.recordEvent(eventType, reason, fmt.Sprintf("node group %q: %s", g.Id(), message))
+}
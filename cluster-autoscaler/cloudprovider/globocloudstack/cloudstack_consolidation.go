@@ -0,0 +1,232 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+)
+
+var consolidationVMsRemoved = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "cloudstack_consolidation_vms_removed_total",
+	Help: "Number of VMs removed by the consolidation loop across every node group.",
+})
+
+// Utilization sums the CPU and memory requests of every pod scheduled on a
+// node, so the consolidation loop can tell how much of a node group's
+// capacity is actually spoken for. It's pluggable - like csScaler's own
+// kubeClient - so the real, Kubernetes API backed implementation can be
+// swapped for a fake one in tests.
+type Utilization interface {
+	// NodeRequests returns the summed CPU request, in millicores, and
+	// summed memory request, in bytes, of every pod scheduled on nodeName.
+	NodeRequests(ctx context.Context, nodeName string) (cpuMillis int64, memBytes int64, err error)
+}
+
+// kubeUtilization is the Utilization backed by the real Kubernetes API,
+// reusing csScaler's lazily built in-cluster client so consolidation
+// doesn't need a second one.
+type kubeUtilization struct {
+	getKubeClient func() (kubernetes.Interface, error)
+}
+
+func (u *kubeUtilization) NodeRequests(ctx context.Context, nodeName string) (int64, int64, error) {
+	kubeClient, err := u.getKubeClient()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pods, err := kubeClient.CoreV1().Pods(apiv1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", nodeName),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var cpuMillis, memBytes int64
+	for i := range pods.Items {
+		for _, c := range pods.Items[i].Spec.Containers {
+			cpuMillis += c.Resources.Requests.Cpu().MilliValue()
+			memBytes += c.Resources.Requests.Memory().Value()
+		}
+	}
+	return cpuMillis, memBytes, nil
+}
+
+// runConsolidationLoop periodically shrinks node groups beyond what the
+// cluster-autoscaler's own scale-down already does, Karpenter
+// consolidation-style: every tick it looks for the smallest number of VMs
+// it can remove from each node group while keeping the remaining VMs'
+// utilization under threshold. It runs until m.ctx is cancelled.
+func (m *cloudstackManager) runConsolidationLoop(interval time.Duration, threshold float64) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.consolidate(threshold); err != nil {
+				klog.Errorf("failed to consolidate node groups: %v", err)
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// consolidate scans every known node group and removes consolidationCandidates
+// from each, via the same node-deletion path the autoscaler core uses
+// (csNodeGroup.DeleteNodes), which drains bookkeeping state and calls
+// csScaler.destroyVM.
+func (m *cloudstackManager) consolidate(threshold float64) error {
+	ctx, cancel := m.callContext()
+	defer cancel()
+
+	kubeClient, err := m.scaler.getKubeClient()
+	if err != nil {
+		return fmt.Errorf("getting kube client for consolidation: %w", err)
+	}
+
+	// Only this pointer snapshot is taken under lock - nodesForNodeGroup
+	// lists Kubernetes Nodes and ng.DeleteNodes makes real destroyVM calls,
+	// and holding nodeGroupsMu's write lock across those, serially for every
+	// node group, would stall every other reader of m.nodeGroups (notably
+	// getNodeGroups, polled every autoscaler loop) for as long as the whole
+	// pass takes. The *csNodeGroup pointers are mutated directly - the same
+	// ones csCloudProvider.NodeGroups hands the autoscaler core itself - so
+	// no merge-back is needed.
+	m.nodeGroupsMu.RLock()
+	nodeGroups := make([]*csNodeGroup, len(m.nodeGroups))
+	for i := range m.nodeGroups {
+		nodeGroups[i] = &m.nodeGroups[i]
+	}
+	m.nodeGroupsMu.RUnlock()
+
+	var errs []string
+	for _, ng := range nodeGroups {
+		nodes, err := nodesForNodeGroup(ctx, kubeClient, ng)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("node group %q: %v", ng.Id(), err))
+			continue
+		}
+
+		candidates, err := consolidationCandidates(ctx, m.utilization, ng, nodes, threshold)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("node group %q: %v", ng.Id(), err))
+			continue
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+
+		if err := ng.DeleteNodes(candidates); err != nil {
+			errs = append(errs, fmt.Sprintf("node group %q: %v", ng.Id(), err))
+			continue
+		}
+		consolidationVMsRemoved.Add(float64(len(candidates)))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("consolidating node groups: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// nodesForNodeGroup resolves every VM in ng to its Kubernetes Node, skipping
+// (with a log line) any VM that hasn't registered a Node yet - there's
+// nothing to drain or measure utilization for until it has.
+func nodesForNodeGroup(ctx context.Context, kubeClient kubernetes.Interface, ng *csNodeGroup) ([]*apiv1.Node, error) {
+	nodes := make([]*apiv1.Node, 0, len(ng.vms))
+	for _, vm := range ng.vms {
+		node, err := nodeForProviderID(ctx, kubeClient, ng.providerID(vm.Id))
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			klog.V(3).Infof("VM %q (node group %q) has no registered Node yet, excluding it from consolidation", vm.Id, ng.Id())
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// consolidationCandidates computes the minimum number of nodes k>=1 that can
+// be removed from ng while keeping the sum of every remaining pod's
+// resource requests at or below (len(nodes)-k) * per-VM capacity *
+// threshold, for both CPU and memory, and never dropping below ng.MinSize().
+// The size it starts from is len(nodes), ng's VMs with a registered Node,
+// not ng's TargetSize: VMs without a Node and pending deployments are not
+// counted.
+// When such a k exists, it returns the k nodes with the lowest utilization
+// of their own - the cheapest to reschedule elsewhere - as the ones to
+// remove.
+func consolidationCandidates(ctx context.Context, u Utilization, ng *csNodeGroup, nodes []*apiv1.Node, threshold float64) ([]*apiv1.Node, error) {
+	type usage struct {
+		node     *apiv1.Node
+		cpu, mem int64
+	}
+
+	usages := make([]usage, 0, len(nodes))
+	var totalCPU, totalMem int64
+	for _, node := range nodes {
+		cpu, mem, err := u.NodeRequests(ctx, node.Name)
+		if err != nil {
+			return nil, fmt.Errorf("getting utilization for node %q: %w", node.Name, err)
+		}
+		usages = append(usages, usage{node: node, cpu: cpu, mem: mem})
+		totalCPU += cpu
+		totalMem += mem
+	}
+
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].cpu+usages[i].mem < usages[j].cpu+usages[j].mem
+	})
+
+	capacityCPU := int64(ng.vmProfile.offering.Cpunumber) * 1000
+	capacityMem := int64(ng.vmProfile.offering.Memory) * 1000 * 1000
+	targetSize := len(nodes)
+	minSize := ng.MinSize()
+
+	for k := 1; k <= len(usages) && targetSize-k >= minSize; k++ {
+		remaining := float64(targetSize - k)
+		cpuLimit := remaining * float64(capacityCPU) * threshold
+		memLimit := remaining * float64(capacityMem) * threshold
+		if float64(totalCPU) > cpuLimit || float64(totalMem) > memLimit {
+			continue
+		}
+		candidates := make([]*apiv1.Node, k)
+		for i := 0; i < k; i++ {
+			candidates[i] = usages[i].node
+		}
+		return candidates, nil
+	}
+	return nil, nil
+}
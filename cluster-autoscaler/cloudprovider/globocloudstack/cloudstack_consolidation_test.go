@@ -0,0 +1,93 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeUtilization map[string][2]int64
+
+func (f fakeUtilization) NodeRequests(ctx context.Context, nodeName string) (int64, int64, error) {
+	u := f[nodeName]
+	return u[0], u[1], nil
+}
+
+func nodeGroupForConsolidation() *csNodeGroup {
+	p := baseVMProfile()
+	p.offering = cloudstack.ServiceOffering{Cpunumber: 1, Memory: 1000}
+	p.aspMetadata[autoScaleProfileMetadataMin] = "0"
+	return &csNodeGroup{vmProfile: p}
+}
+
+func Test_consolidationCandidates_removesUnderutilizedNode(t *testing.T) {
+	ng := nodeGroupForConsolidation()
+	nodes := []*apiv1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+	}
+	// Each node has 1000m CPU / 1000MB capacity. Combined usage easily fits
+	// on a single node at the 0.5 threshold.
+	u := fakeUtilization{
+		"node1": {100, 100 * 1000 * 1000},
+		"node2": {200, 200 * 1000 * 1000},
+	}
+
+	candidates, err := consolidationCandidates(context.Background(), u, ng, nodes, 0.5)
+
+	require.NoError(t, err)
+	require.Len(t, candidates, 1)
+	assert.Equal(t, "node1", candidates[0].Name)
+}
+
+func Test_consolidationCandidates_noneWhenAboveThreshold(t *testing.T) {
+	ng := nodeGroupForConsolidation()
+	nodes := []*apiv1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+	}
+	u := fakeUtilization{
+		"node1": {900, 900 * 1000 * 1000},
+		"node2": {900, 900 * 1000 * 1000},
+	}
+
+	candidates, err := consolidationCandidates(context.Background(), u, ng, nodes, 0.5)
+
+	require.NoError(t, err)
+	assert.Empty(t, candidates)
+}
+
+func Test_consolidationCandidates_neverBelowMinSize(t *testing.T) {
+	ng := nodeGroupForConsolidation()
+	ng.vmProfile.aspMetadata[autoScaleProfileMetadataMin] = "1"
+	nodes := []*apiv1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+	}
+	u := fakeUtilization{"node1": {10, 10 * 1000 * 1000}}
+
+	candidates, err := consolidationCandidates(context.Background(), u, ng, nodes, 0.5)
+
+	require.NoError(t, err)
+	assert.Empty(t, candidates)
+}
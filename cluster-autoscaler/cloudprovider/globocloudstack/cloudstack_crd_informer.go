@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+var cloudstackNodeGroupGVR = schema.GroupVersionResource{
+	Group:    "autoscaler.tsuru.io",
+	Version:  "v1",
+	Resource: "cloudstacknodegroups",
+}
+
+// crdSharedInformer backs a cloudstackNodeGroupInformer with a client-go
+// shared index informer, the same pattern cluster-api based providers use
+// to watch their infrastructure objects from inside the cluster.
+type crdSharedInformer struct {
+	lister cache.GenericLister
+}
+
+// newCRDInformer builds and starts a shared informer that watches
+// CloudstackNodeGroup objects in namespace. stopCh is closed by
+// cloudstackManager.Cleanup to stop the informer's goroutines.
+func newCRDInformer(namespace string, stopCh <-chan struct{}) (cloudstackNodeGroupInformer, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("building in-cluster config for CloudstackNodeGroup informer: %w", err)
+	}
+
+	client, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("building dynamic client for CloudstackNodeGroup informer: %w", err)
+	}
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, defaultProjectRefreshInterval, namespace, nil)
+	informer := factory.ForResource(cloudstackNodeGroupGVR)
+
+	go informer.Informer().Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.Informer().HasSynced) {
+		return nil, fmt.Errorf("timed out waiting for CloudstackNodeGroup informer cache to sync")
+	}
+
+	return &crdSharedInformer{lister: informer.Lister()}, nil
+}
+
+func (c *crdSharedInformer) List() ([]CloudstackNodeGroup, error) {
+	objs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]CloudstackNodeGroup, 0, len(objs))
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		var group CloudstackNodeGroup
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &group); err != nil {
+			return nil, fmt.Errorf("decoding CloudstackNodeGroup %s/%s: %w", u.GetNamespace(), u.GetName(), err)
+		}
+		group.Name = u.GetName()
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
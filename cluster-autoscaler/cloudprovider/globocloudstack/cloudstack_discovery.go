@@ -0,0 +1,268 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+)
+
+const autoDiscovererTypeCRD = "crd"
+
+// discoveredASP is an AutoScaleVmProfile paired with the metadata that
+// decides whether it should become a node group and, if so, which overrides
+// (labels, size bounds) apply to it. It is the common currency
+// every NodeGroupDiscoverer speaks, regardless of where the ASP was found
+// (resource-detail tags or a CloudstackNodeGroup CRD).
+type discoveredASP struct {
+	asp      cloudstack.AutoScaleVmProfile
+	metadata map[string]string
+}
+
+// NodeGroupDiscoverer finds AutoScaleVmProfiles that should be managed as
+// node groups. newManager wires up one discoverer per entry in
+// NodeGroupAutoDiscoverySpecs, and Refresh merges the results of every
+// active discoverer on each cycle.
+type NodeGroupDiscoverer interface {
+	Discover() ([]discoveredASP, error)
+}
+
+// resourceDetailDiscoverer is the original discovery mode: it lists every
+// AutoScaleVmProfile (optionally scoped to a CloudStack project) and keeps
+// the ones whose ResourceDetail metadata matches a configured label
+// selector.
+type resourceDetailDiscoverer struct {
+	manager     *cloudstackManager
+	labelConfig []labelAutoDiscoveryConfig
+}
+
+func newResourceDetailDiscoverer(m *cloudstackManager, labelConfig []labelAutoDiscoveryConfig) *resourceDetailDiscoverer {
+	return &resourceDetailDiscoverer{manager: m, labelConfig: labelConfig}
+}
+
+func (d *resourceDetailDiscoverer) Discover() ([]discoveredASP, error) {
+	ctx, cancel := d.manager.callContext()
+	defer cancel()
+
+	var found []discoveredASP
+	err := d.manager.projects.forEach(ctx, func(projectID string) error {
+		var params cloudstack.ListAutoScaleVmProfilesParams
+		if projectID != "" {
+			params.SetProjectid(projectID)
+		}
+		asps, err := d.manager.client.ListAutoScaleVmProfiles(&params)
+		if err != nil {
+			return err
+		}
+		for _, asp := range asps.AutoScaleVmProfiles {
+			var metaParams cloudstack.ListResourceDetailsParams
+			metaParams.SetResourcetype(resourceTypeAutoScaleVmProfile)
+			metaParams.SetResourceid(asp.Id)
+			details, err := d.manager.client.ListResourceDetails(&metaParams)
+			if err != nil {
+				return err
+			}
+			metadata := resourceDetailsToMetadata(details.ResourceDetails)
+			if !validASPMetadata(metadata, d.labelConfig) {
+				continue
+			}
+			found = append(found, discoveredASP{asp: *asp, metadata: metadata})
+		}
+		return nil
+	})
+	return found, err
+}
+
+func validASPMetadata(metadata map[string]string, labelConfig []labelAutoDiscoveryConfig) bool {
+	for _, requiredKey := range requiredAutoScaleProfileMetadata {
+		if _, ok := metadata[requiredKey]; !ok {
+			return false
+		}
+	}
+	return matchesLabelConfigs(metadata, labelConfig)
+}
+
+// crdAutoDiscoveryConfig configures a crdDiscoverer: it watches
+// CloudstackNodeGroup objects in Namespace and resolves each one's ASP
+// through ASPSelector, a set of key/values the ASP's OtherDeployParams
+// query string must carry.
+type crdAutoDiscoveryConfig struct {
+	Namespace string
+}
+
+// crdDiscoverer discovers node groups from CloudstackNodeGroup custom
+// resources (group autoscaler.tsuru.io/v1) instead of requiring operators
+// to tag AutoScaleVmProfiles through the CloudStack API directly. It mirrors
+// how cluster-api providers model infrastructure as in-cluster objects: the
+// CRD's Min, Max and Labels become the node group's size bounds and node
+// labels, and the CRD's aspSelector picks which CloudStack ASP backs it. The
+// CRD's Target and Taints fields are not read.
+type crdDiscoverer struct {
+	manager   *cloudstackManager
+	namespace string
+	informer  cloudstackNodeGroupInformer
+}
+
+// cloudstackNodeGroupInformer is satisfied by a shared informer over the
+// CloudstackNodeGroup CRD. It is an interface so tests can provide an
+// in-memory lister instead of standing up a real API server / CRD.
+type cloudstackNodeGroupInformer interface {
+	List() ([]CloudstackNodeGroup, error)
+}
+
+func newCRDDiscoverer(m *cloudstackManager, cfg crdAutoDiscoveryConfig, informer cloudstackNodeGroupInformer) *crdDiscoverer {
+	return &crdDiscoverer{manager: m, namespace: cfg.Namespace, informer: informer}
+}
+
+func (d *crdDiscoverer) Discover() ([]discoveredASP, error) {
+	groups, err := d.informer.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing CloudstackNodeGroup objects in namespace %q: %w", d.namespace, err)
+	}
+
+	var found []discoveredASP
+	for _, group := range groups {
+		var params cloudstack.ListAutoScaleVmProfilesParams
+		asps, err := d.manager.client.ListAutoScaleVmProfiles(&params)
+		if err != nil {
+			return nil, err
+		}
+		asp := matchASPSelector(asps.AutoScaleVmProfiles, group.Spec.ASPSelector)
+		if asp == nil {
+			continue
+		}
+		found = append(found, discoveredASP{
+			asp:      *asp,
+			metadata: group.metadata(),
+		})
+	}
+	return found, nil
+}
+
+func matchASPSelector(asps []*cloudstack.AutoScaleVmProfile, selector map[string]string) *cloudstack.AutoScaleVmProfile {
+	for _, asp := range asps {
+		values, err := url.ParseQuery(asp.Otherdeployparams)
+		if err != nil {
+			continue
+		}
+		tags := make(map[string]string, len(values))
+		for k := range values {
+			tags[k] = values.Get(k)
+		}
+		if matchesSelector(tags, selector) {
+			return asp
+		}
+	}
+	return nil
+}
+
+// CloudstackNodeGroup is the CRD (group autoscaler.tsuru.io/v1) operators
+// use to declare a node group in-cluster instead of tagging ASPs through
+// the CloudStack API.
+type CloudstackNodeGroup struct {
+	Name string
+	Spec CloudstackNodeGroupSpec
+}
+
+// CloudstackNodeGroupSpec is the desired state of a CloudstackNodeGroup.
+type CloudstackNodeGroupSpec struct {
+	// ASPSelector matches the OtherDeployParams query-string tags of the
+	// AutoScaleVmProfile that should back this node group.
+	ASPSelector map[string]string
+	Min         int
+	Max         int
+	Target      int
+	Labels      map[string]string
+	Taints      []string
+}
+
+func (g CloudstackNodeGroup) metadata() map[string]string {
+	metadata := map[string]string{
+		autoScaleProfileMetadataName: g.Name,
+		autoScaleProfileMetadataMin:  fmt.Sprint(g.Spec.Min),
+		autoScaleProfileMetadataMax:  fmt.Sprint(g.Spec.Max),
+	}
+	for k, v := range g.Spec.Labels {
+		metadata[autoScaleProfileMetadataNodeLabelPrefix+k] = v
+	}
+	return metadata
+}
+
+// parsedAutoDiscoverySpecs is the result of dispatching every configured
+// NodeGroupAutoDiscoverySpec to its discoverer-specific parser.
+type parsedAutoDiscoverySpecs struct {
+	label []labelAutoDiscoveryConfig
+	crd   []crdAutoDiscoveryConfig
+	capi  []capiAutoDiscoveryConfig
+}
+
+func parseAutoDiscoverySpecs(o cloudprovider.NodeGroupDiscoveryOptions) (parsedAutoDiscoverySpecs, error) {
+	var parsed parsedAutoDiscoverySpecs
+	for _, spec := range o.NodeGroupAutoDiscoverySpecs {
+		tokens := strings.SplitN(spec, ":", 2)
+		if len(tokens) != 2 {
+			return parsed, fmt.Errorf("spec \"%s\" should be discoverer:key=value,key=value", spec)
+		}
+		switch tokens[0] {
+		case autoDiscovererTypeLabel:
+			cfg, err := parseLabelAutoDiscoverySpec(spec)
+			if err != nil {
+				return parsed, err
+			}
+			parsed.label = append(parsed.label, cfg)
+		case autoDiscovererTypeCRD:
+			cfg, err := parseCRDAutoDiscoverySpec(tokens[1])
+			if err != nil {
+				return parsed, err
+			}
+			parsed.crd = append(parsed.crd, cfg)
+		case autoDiscovererTypeCAPI:
+			cfg, err := parseCAPIAutoDiscoverySpec(tokens[1])
+			if err != nil {
+				return parsed, err
+			}
+			parsed.capi = append(parsed.capi, cfg)
+		default:
+			return parsed, fmt.Errorf("unsupported discoverer specified: %s", tokens[0])
+		}
+	}
+	return parsed, nil
+}
+
+func parseCRDAutoDiscoverySpec(args string) (crdAutoDiscoveryConfig, error) {
+	cfg := crdAutoDiscoveryConfig{}
+	for _, arg := range strings.Split(args, ",") {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return cfg, fmt.Errorf("invalid key=value pair %s", arg)
+		}
+		switch kv[0] {
+		case "namespace":
+			cfg.Namespace = kv[1]
+		default:
+			return cfg, fmt.Errorf("unsupported crd discoverer option: %s", kv[0])
+		}
+	}
+	if cfg.Namespace == "" {
+		return cfg, fmt.Errorf("crd discoverer requires a namespace, e.g. crd:namespace=kube-system")
+	}
+	return cfg, nil
+}
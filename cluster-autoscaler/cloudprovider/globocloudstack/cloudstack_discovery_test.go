@@ -0,0 +1,139 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+)
+
+func Test_parseAutoDiscoverySpecs(t *testing.T) {
+	parsed, err := parseAutoDiscoverySpecs(cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"label:a=b", "crd:namespace=kube-system", "capi:namespace=capi-system,clusterName=mycluster"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []labelAutoDiscoveryConfig{{Selector: map[string]string{"a": "b"}}}, parsed.label)
+	assert.Equal(t, []crdAutoDiscoveryConfig{{Namespace: "kube-system"}}, parsed.crd)
+	assert.Equal(t, []capiAutoDiscoveryConfig{{Namespace: "capi-system", ClusterName: "mycluster"}}, parsed.capi)
+
+	_, err = parseAutoDiscoverySpecs(cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"crd:foo=bar"},
+	})
+	require.Error(t, err)
+
+	_, err = parseAutoDiscoverySpecs(cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"crd:namespace="},
+	})
+	require.Error(t, err)
+
+	_, err = parseAutoDiscoverySpecs(cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"capi:namespace=capi-system"},
+	})
+	require.Error(t, err)
+}
+
+func Test_resourceDetailDiscoverer_Discover(t *testing.T) {
+	cli := &fakeClient{}
+	cli.On("ListAutoScaleVmProfiles", mock.Anything).Return(&cloudstack.ListAutoScaleVmProfilesResponse{
+		AutoScaleVmProfiles: []*cloudstack.AutoScaleVmProfile{
+			{Id: "asp1"},
+			{Id: "asp2"},
+		},
+	}, nil)
+	params1 := cloudstack.ListResourceDetailsParams{}
+	params1.SetResourcetype(resourceTypeAutoScaleVmProfile)
+	params1.SetResourceid("asp1")
+	cli.On("ListResourceDetails", &params1).Return(&cloudstack.ListResourceDetailsResponse{
+		ResourceDetails: []*cloudstack.ResourceDetail{
+			{Key: "nodeGroupName", Value: "ng1"},
+			{Key: "minNodes", Value: "0"},
+			{Key: "maxNodes", Value: "5"},
+			{Key: "a", Value: "b"},
+		},
+	}, nil)
+
+	params2 := cloudstack.ListResourceDetailsParams{}
+	params2.SetResourcetype(resourceTypeAutoScaleVmProfile)
+	params2.SetResourceid("asp2")
+	cli.On("ListResourceDetails", &params2).Return(&cloudstack.ListResourceDetailsResponse{
+		ResourceDetails: []*cloudstack.ResourceDetail{
+			{Key: "nodeGroupName", Value: "ng2"},
+			{Key: "minNodes", Value: "0"},
+			{Key: "maxNodes", Value: "5"},
+		},
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &cloudstackManager{
+		client:     cli,
+		apiTimeout: time.Second,
+		ctx:        ctx,
+		projects:   &projectCache{client: cli},
+	}
+	d := newResourceDetailDiscoverer(m, []labelAutoDiscoveryConfig{{Selector: map[string]string{"a": "b"}}})
+
+	found, err := d.Discover()
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "asp1", found[0].asp.Id)
+}
+
+type fakeCRDInformer struct {
+	groups []CloudstackNodeGroup
+}
+
+func (f *fakeCRDInformer) List() ([]CloudstackNodeGroup, error) {
+	return f.groups, nil
+}
+
+func Test_crdDiscoverer_Discover(t *testing.T) {
+	cli := &fakeClient{}
+	cli.On("ListAutoScaleVmProfiles", mock.Anything).Return(&cloudstack.ListAutoScaleVmProfilesResponse{
+		AutoScaleVmProfiles: []*cloudstack.AutoScaleVmProfile{
+			{Id: "asp1", Otherdeployparams: "aspgroup=workers"},
+		},
+	}, nil)
+
+	m := &cloudstackManager{client: cli}
+	informer := &fakeCRDInformer{groups: []CloudstackNodeGroup{
+		{
+			Name: "workers",
+			Spec: CloudstackNodeGroupSpec{
+				ASPSelector: map[string]string{"aspgroup": "workers"},
+				Min:         1,
+				Max:         3,
+			},
+		},
+	}}
+	d := newCRDDiscoverer(m, crdAutoDiscoveryConfig{Namespace: "kube-system"}, informer)
+
+	found, err := d.Discover()
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "asp1", found[0].asp.Id)
+	assert.Equal(t, "workers", found[0].metadata[autoScaleProfileMetadataName])
+	assert.Equal(t, "1", found[0].metadata[autoScaleProfileMetadataMin])
+	assert.Equal(t, "3", found[0].metadata[autoScaleProfileMetadataMax])
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// autoScaleProfileMetadataDisruptionBudgetNodes caps how many VMs in a
+	// node group may be disrupting (deleted, or mid drift-replacement) at
+	// once. Accepts either an absolute count ("3") or a percentage of the
+	// node group's current size ("20%"), mirroring Karpenter's NodePool
+	// disruption budgets. Unset means unbounded, preserving the previous
+	// behavior.
+	autoScaleProfileMetadataDisruptionBudgetNodes = "disruptionBudget.nodes"
+
+	// autoScaleProfileMetadataDisruptionBudgetSchedule restricts
+	// disruptionBudget.nodes to a recurring time window, so e.g. a tighter
+	// budget only applies outside business hours. Only the "@daily
+	// start-end" form is supported (start/end are 0-23 hours in the
+	// controller's local time); any other value is rejected rather than
+	// silently ignored. Unset means the budget is always active.
+	autoScaleProfileMetadataDisruptionBudgetSchedule = "disruptionBudget.schedule"
+)
+
+// ErrDisruptionBudgetExceeded is returned by csNodeGroup.DeleteNodes when
+// honoring a request would disrupt more VMs than the node group's
+// disruptionBudget.nodes metadata currently allows. Callers (the
+// cluster-autoscaler core) are expected to back off and retry later rather
+// than treat it as a permanent failure. ReplaceDrifted does not return it:
+// it skips a node group with no allowance left until a later tick.
+var ErrDisruptionBudgetExceeded = errors.New("disruption budget exceeded")
+
+// disruptionSchedule is the parsed form of
+// autoScaleProfileMetadataDisruptionBudgetSchedule.
+type disruptionSchedule struct {
+	startHour, endHour int
+}
+
+// parseDisruptionSchedule parses the "@daily start-end" form described on
+// autoScaleProfileMetadataDisruptionBudgetSchedule.
+func parseDisruptionSchedule(s string) (*disruptionSchedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 || fields[0] != "@daily" {
+		return nil, fmt.Errorf("unsupported disruption budget schedule %q: only \"@daily start-end\" is supported", s)
+	}
+
+	bounds := strings.SplitN(fields[1], "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("unsupported disruption budget schedule %q: window must be \"start-end\"", s)
+	}
+	start, errStart := strconv.Atoi(bounds[0])
+	end, errEnd := strconv.Atoi(bounds[1])
+	if errStart != nil || errEnd != nil || start < 0 || start > 23 || end < 0 || end > 23 {
+		return nil, fmt.Errorf("unsupported disruption budget schedule %q: hours must be 0-23", s)
+	}
+
+	return &disruptionSchedule{startHour: start, endHour: end}, nil
+}
+
+// active reports whether t falls inside the schedule's daily window. Windows
+// that wrap past midnight (e.g. 22-4) are supported.
+func (d *disruptionSchedule) active(t time.Time) bool {
+	hour := t.Hour()
+	if d.startHour <= d.endHour {
+		return hour >= d.startHour && hour <= d.endHour
+	}
+	return hour >= d.startHour || hour <= d.endHour
+}
+
+// disruptionBudget resolves this profile's disruptionBudget.nodes/.schedule
+// metadata into the maximum number of VMs out of currentSize that may be
+// disrupting at once, at time t. A profile without
+// autoScaleProfileMetadataDisruptionBudgetNodes set is unbounded.
+func (p *vmProfile) disruptionBudget(currentSize int, t time.Time) (int, error) {
+	raw, ok := p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes]
+	if !ok || raw == "" {
+		return currentSize, nil
+	}
+
+	if schedule, ok := p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetSchedule]; ok && schedule != "" {
+		parsed, err := parseDisruptionSchedule(schedule)
+		if err != nil {
+			return 0, err
+		}
+		if !parsed.active(t) {
+			return currentSize, nil
+		}
+	}
+
+	if strings.HasSuffix(raw, "%") {
+		n, err := strconv.Atoi(strings.TrimSuffix(raw, "%"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid disruption budget %q: %w", raw, err)
+		}
+		return currentSize * n / 100, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid disruption budget %q: %w", raw, err)
+	}
+	return n, nil
+}
+
+// GetAllowedDisruptions returns how many more VMs in g may be disrupted
+// (deleted via DeleteNodes, or replaced for drift) right now without
+// exceeding its disruptionBudget.nodes AutoScaleVmProfile metadata. It never
+// returns a negative number.
+func (g *csNodeGroup) GetAllowedDisruptions() (int, error) {
+	budget, err := g.vmProfile.disruptionBudget(len(g.vms), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	disrupting := g.disruptingCount()
+	allowed := budget - disrupting
+	if allowed < 0 {
+		allowed = 0
+	}
+	return allowed, nil
+}
+
+// disruptingCount counts VMs already mid-disruption: Stopped, Starting,
+// Stopping or Expunging (CloudStack's states while a VM is being torn down
+// or is about to be) plus
+// any VM already queued for drift replacement (see g.driftedVMIDs) - a
+// drifted VM is still Running until replaceDriftedVM's destroyVM call
+// succeeds, so it wouldn't otherwise be counted until the disruption it's
+// about to cause has already happened.
+func (g *csNodeGroup) disruptingCount() int {
+	counted := make(map[string]bool, len(g.driftedVMIDs))
+	var count int
+	for _, vm := range g.vms {
+		switch vm.State {
+		case "Stopped", "Starting", "Stopping", "Expunging":
+			count++
+			counted[vm.Id] = true
+		}
+	}
+	for vmID := range g.driftedVMIDs {
+		if !counted[vmID] {
+			count++
+		}
+	}
+	return count
+}
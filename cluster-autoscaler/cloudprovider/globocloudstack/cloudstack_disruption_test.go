@@ -0,0 +1,151 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func Test_vmProfile_disruptionBudget_unsetIsUnbounded(t *testing.T) {
+	p := baseVMProfile()
+	budget, err := p.disruptionBudget(10, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 10, budget)
+}
+
+func Test_vmProfile_disruptionBudget_absolute(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes] = "3"
+	budget, err := p.disruptionBudget(10, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 3, budget)
+}
+
+func Test_vmProfile_disruptionBudget_percentage(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes] = "20%"
+	budget, err := p.disruptionBudget(10, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, budget)
+}
+
+func Test_vmProfile_disruptionBudget_scheduleOutsideWindowIsUnbounded(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes] = "1"
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetSchedule] = "@daily 0-4"
+
+	outsideWindow := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	budget, err := p.disruptionBudget(10, outsideWindow)
+	require.NoError(t, err)
+	assert.Equal(t, 10, budget)
+}
+
+func Test_vmProfile_disruptionBudget_scheduleInsideWindowApplies(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes] = "1"
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetSchedule] = "@daily 0-4"
+
+	insideWindow := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	budget, err := p.disruptionBudget(10, insideWindow)
+	require.NoError(t, err)
+	assert.Equal(t, 1, budget)
+}
+
+func Test_vmProfile_disruptionBudget_invalidSchedule(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes] = "1"
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetSchedule] = "every night"
+
+	_, err := p.disruptionBudget(10, time.Now())
+	assert.Error(t, err)
+}
+
+func Test_csNodeGroup_GetAllowedDisruptions(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes] = "1"
+
+	ng := csNodeGroup{
+		vmProfile: p,
+		vms: []*cloudstack.VirtualMachine{
+			{Id: "vm1", State: "Running"},
+			{Id: "vm2", State: "Stopped"},
+		},
+	}
+
+	allowed, err := ng.GetAllowedDisruptions()
+	require.NoError(t, err)
+	assert.Equal(t, 0, allowed)
+}
+
+func Test_csNodeGroup_GetAllowedDisruptions_countsInProgressDrift(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes] = "1"
+
+	// vm-drifted is still Running - ReplaceDrifted hasn't destroyed it yet -
+	// but it's already queued in driftedVMIDs, so it must count against the
+	// budget the same as an already-Stopped VM would, or a concurrent
+	// DeleteNodes/consolidation call could disrupt one more VM than the
+	// budget allows.
+	ng := csNodeGroup{
+		vmProfile:    p,
+		vms:          []*cloudstack.VirtualMachine{{Id: "vm-drifted", State: "Running"}, {Id: "vm2", State: "Running"}},
+		driftedVMIDs: map[string]string{"vm-drifted": "TemplateDrift"},
+	}
+
+	allowed, err := ng.GetAllowedDisruptions()
+	require.NoError(t, err)
+	assert.Equal(t, 0, allowed)
+}
+
+func Test_csNodeGroup_GetAllowedDisruptions_driftedVMAlreadyStoppedIsNotDoubleCounted(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes] = "2"
+
+	ng := csNodeGroup{
+		vmProfile:    p,
+		vms:          []*cloudstack.VirtualMachine{{Id: "vm-drifted", State: "Stopped"}},
+		driftedVMIDs: map[string]string{"vm-drifted": "TemplateDrift"},
+	}
+
+	allowed, err := ng.GetAllowedDisruptions()
+	require.NoError(t, err)
+	assert.Equal(t, 1, allowed, "a VM that is both Stopped and drifted must only count once")
+}
+
+func Test_csNodeGroup_DeleteNodes_rejectsWhenBudgetExceeded(t *testing.T) {
+	p := baseVMProfile()
+	p.asp = cloudstack.AutoScaleVmProfile{}
+	p.aspMetadata[autoScaleProfileMetadataProviderIDPrefix] = "cloudstack://"
+	p.aspMetadata[autoScaleProfileMetadataDisruptionBudgetNodes] = "0"
+
+	ng := &csNodeGroup{
+		vmProfile: p,
+		vms:       []*cloudstack.VirtualMachine{{Id: "vm1", State: "Running"}},
+	}
+
+	node := &apiv1.Node{Spec: apiv1.NodeSpec{ProviderID: "cloudstack://vm1"}}
+	err := ng.DeleteNodes([]*apiv1.Node{node})
+
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrDisruptionBudgetExceeded)
+}
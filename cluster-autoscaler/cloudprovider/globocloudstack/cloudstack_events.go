@@ -0,0 +1,202 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	klog "k8s.io/klog/v2"
+)
+
+// defaultEventObjectRef names the Kubernetes Namespace that NodeGroupCondition
+// transitions are recorded against (see cloudstackManager.recordEvent), since
+// a node group isn't itself a namespaced Kubernetes object Events can be
+// attached to. Overridden by csConfig.EventObjectRef.
+const defaultEventObjectRef = "kube-system"
+
+var (
+	vmCreateDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cloudstack_vm_create_duration_seconds",
+		Help:    "Duration of csScaler.createVM calls, success or failure.",
+		Buckets: prometheus.DefBuckets,
+	})
+	vmCreateErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudstack_vm_create_errors_total",
+		Help: "Number of csScaler.createVM calls that failed, by the step that failed (deploy or tag).",
+	}, []string{"reason"})
+	vmDestroyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cloudstack_vm_destroy_duration_seconds",
+		Help:    "Duration of csScaler.destroyVM calls, success or failure.",
+		Buckets: prometheus.DefBuckets,
+	})
+	nodeGroupSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cloudstack_node_group_size",
+		Help: "Number of VMs in a node group: state=ready counts every VM in the group, drifted ones included; state=drifted counts the drifted ones.",
+	}, []string{"group", "state"})
+	nodeGroupScaleUpTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudstack_scaleup_total",
+		Help: "Number of VMs manager.scaleUp has attempted to create, by node group.",
+	}, []string{"nodeGroupName"})
+	nodeGroupScaleUpFailedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudstack_scaleup_failed_total",
+		Help: "Number of manager.scaleUp calls that failed to reach their requested size, by node group.",
+	}, []string{"nodeGroupName"})
+	nodeGroupDestroyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudstack_destroy_total",
+		Help: "Number of VMs csNodeGroup.DeleteNodes has destroyed, by node group.",
+	}, []string{"nodeGroupName"})
+)
+
+// EventRecorder emits Kubernetes Events for a VM's lifecycle, Karpenter
+// NodeClaim-style: Launching/LaunchFailed fire before a VM id exists (there
+// is nothing CloudStack-side to attach them to yet, so they're only
+// identified by the node group), the rest fire once a providerID exists and
+// are attached to the backing Node when one has registered.
+type EventRecorder interface {
+	Launching(nodeGroupID string)
+	Launched(nodeGroupID, providerID string)
+	LaunchFailed(nodeGroupID string, err error)
+	Terminating(nodeGroupID, providerID string)
+	Terminated(nodeGroupID, providerID string)
+	TerminationFailed(nodeGroupID, providerID string, err error)
+}
+
+// kubeEventRecorder is the EventRecorder backed by the real Kubernetes API,
+// reusing csScaler's lazily built in-cluster client like
+// emitScaleUpTimeoutEvent already does.
+type kubeEventRecorder struct {
+	getKubeClient func() (kubernetes.Interface, error)
+}
+
+func (r *kubeEventRecorder) Launching(nodeGroupID string) {
+	r.emit("", "Launching", apiv1.EventTypeNormal, fmt.Sprintf("node group %q: launching a new VM", nodeGroupID))
+}
+
+func (r *kubeEventRecorder) Launched(nodeGroupID, providerID string) {
+	r.emit(providerID, "Launched", apiv1.EventTypeNormal, fmt.Sprintf("node group %q: VM %q created and tagged", nodeGroupID, providerID))
+}
+
+func (r *kubeEventRecorder) LaunchFailed(nodeGroupID string, err error) {
+	r.emit("", "LaunchFailed", apiv1.EventTypeWarning, fmt.Sprintf("node group %q: failed to launch VM: %v", nodeGroupID, err))
+}
+
+func (r *kubeEventRecorder) Terminating(nodeGroupID, providerID string) {
+	r.emit(providerID, "Terminating", apiv1.EventTypeNormal, fmt.Sprintf("node group %q: terminating VM %q", nodeGroupID, providerID))
+}
+
+func (r *kubeEventRecorder) Terminated(nodeGroupID, providerID string) {
+	r.emit(providerID, "Terminated", apiv1.EventTypeNormal, fmt.Sprintf("node group %q: VM %q terminated", nodeGroupID, providerID))
+}
+
+func (r *kubeEventRecorder) TerminationFailed(nodeGroupID, providerID string, err error) {
+	r.emit(providerID, "TerminationFailed", apiv1.EventTypeWarning, fmt.Sprintf("node group %q: failed to terminate VM %q: %v", nodeGroupID, providerID, err))
+}
+
+// emit records a Kubernetes Event, attached to the Node backing providerID
+// when one has already registered, falling back to providerID itself as the
+// reference's Name (left empty when providerID is empty too) so events
+// before a Node exists still surface somewhere.
+func (r *kubeEventRecorder) emit(providerID, reason, eventType, message string) {
+	kubeClient, err := r.getKubeClient()
+	if err != nil {
+		klog.Errorf("failed to emit %s event: %v", reason, err)
+		return
+	}
+
+	ref := apiv1.ObjectReference{Kind: "Node", Name: providerID}
+	if providerID != "" {
+		if node, err := nodeForProviderID(context.Background(), kubeClient, providerID); err == nil && node != nil {
+			ref = apiv1.ObjectReference{Kind: "Node", Name: node.Name, UID: node.UID}
+		}
+	}
+
+	now := metav1.Now()
+	event := &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "cloudstack-vm-" + strings.ToLower(reason) + "-",
+			Namespace:    eventNamespace,
+		},
+		InvolvedObject: ref,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         apiv1.EventSource{Component: "cluster-autoscaler-globocloudstack"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := kubeClient.CoreV1().Events(eventNamespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		klog.Errorf("failed to emit %s event: %v", reason, err)
+	}
+}
+
+// recordNodeGroupSize updates cloudstack_node_group_size for ng from its
+// current in-memory state. Called whenever ng.vms or ng.driftedVMIDs
+// changes (refreshNodeGroupVms, DeleteNodes).
+func recordNodeGroupSize(ng *csNodeGroup) {
+	nodeGroupSize.WithLabelValues(ng.Id(), "ready").Set(float64(len(ng.vms)))
+	nodeGroupSize.WithLabelValues(ng.Id(), "drifted").Set(float64(len(ng.driftedVMIDs)))
+}
+
+// eventRecorder lazily builds the record.EventRecorder backing recordEvent,
+// reusing scaler.getKubeClient's lazily built in-cluster client so
+// newManager doesn't require a real in-cluster config when no
+// NodeGroupCondition transition is ever recorded (e.g. in unit tests).
+func (m *cloudstackManager) eventRecorder() (record.EventRecorder, *apiv1.ObjectReference, error) {
+	m.eventRecorderOnce.Do(func() {
+		kubeClient, err := m.scaler.getKubeClient()
+		if err != nil {
+			m.eventRecorderErr = fmt.Errorf("building event recorder for node-group conditions: %w", err)
+			return
+		}
+
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+		m.recorder = broadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{Component: "cluster-autoscaler-globocloudstack"})
+
+		ref := m.config.EventObjectRef
+		if ref == "" {
+			ref = defaultEventObjectRef
+		}
+		m.eventRef = &apiv1.ObjectReference{Kind: "Namespace", Name: ref}
+	})
+	return m.recorder, m.eventRef, m.eventRecorderErr
+}
+
+// recordEvent emits a Kubernetes Event for a NodeGroupCondition transition
+// (see csNodeGroup.setCondition) against the object named by
+// csConfig.EventObjectRef. Failures to build the recorder or emit the event
+// are only logged, mirroring kubeEventRecorder.emit: a missing Event must
+// never fail the scale operation it is describing.
+func (m *cloudstackManager) recordEvent(eventType, reason, message string) {
+	recorder, ref, err := m.eventRecorder()
+	if err != nil {
+		klog.Errorf("failed to emit %s event: %v", reason, err)
+		return
+	}
+	recorder.Event(ref, eventType, reason, message)
+}
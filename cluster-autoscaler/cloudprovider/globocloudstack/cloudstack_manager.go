@@ -0,0 +1,1231 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/client-go/tools/record"
+	klog "k8s.io/klog/v2"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+const (
+	defaultProjectRefreshInterval   = 30 * time.Minute
+	defaultAPITimeout               = 30 * time.Second
+	defaultScaleUpTimeout           = 15 * time.Minute
+	defaultDriftReplacementInterval = 5 * time.Minute
+	defaultMaxDriftedPerInterval    = 1
+
+	defaultConsolidationInterval  = 10 * time.Minute
+	defaultConsolidationThreshold = 0.5
+
+	defaultScaleUpMaxConcurrency   = 8
+	defaultScaleUpPerCallTimeout   = 2 * time.Minute
+	defaultScaleUpRetryMaxAttempts = 3
+	defaultScaleUpRetryBaseDelay   = 2 * time.Second
+	defaultScaleUpRetryMaxDelay    = 30 * time.Second
+	defaultScaleUpRateLimitQPS     = 4.0
+
+	resourceTypeAutoScaleVmProfile = "AutoScaleVmProfile"
+	resourceTypeVirtualMachine     = "UserVm"
+	resourceTypeServiceOffering    = "ServiceOffering"
+
+	// resourceDetailKeyPrice is the ResourceDetail CloudStack attaches to a
+	// ServiceOffering to record its hourly price, when one is configured.
+	resourceDetailKeyPrice = "price"
+
+	// nodeGroupProfileHashTag is the VM tag csScaler stamps at creation time
+	// with vmProfile.driftHash(), so a later Refresh can tell whether the VM
+	// still matches its AutoScaleVmProfile. VMs created before drift
+	// detection existed simply don't carry this tag.
+	nodeGroupProfileHashTag = "nodeGroupProfileHash"
+
+	// The nodeGroup*HashTag constants are the per-driftCategory tags
+	// csScaler stamps alongside nodeGroupProfileHashTag, so a VM whose
+	// combined hash no longer matches can be traced back to the specific
+	// category (offering, template, ...) that changed. See driftCategories.
+	nodeGroupOfferingHashTag     = "nodeGroupOfferingHash"
+	nodeGroupTemplateHashTag     = "nodeGroupTemplateHash"
+	nodeGroupZoneHashTag         = "nodeGroupZoneHash"
+	nodeGroupDeployParamsHashTag = "nodeGroupDeployParamsHash"
+	nodeGroupUserDataHashTag     = "nodeGroupUserDataHash"
+	nodeGroupTagsHashTag         = "nodeGroupTagsHash"
+
+	autoDiscovererTypeLabel = "label"
+
+	autoScaleProfileMetadataName             = "nodeGroupName"
+	autoScaleProfileMetadataMin              = "minNodes"
+	autoScaleProfileMetadataMax              = "maxNodes"
+	autoScaleProfileMetadataUserdata         = "userdata"
+	autoScaleProfileMetadataProviderIDPrefix = "providerIDPrefix"
+
+	autoScaleProfileMetadataNodeLabelPrefix = "label-"
+	autoScaleProfileMetadataVMTagPrefix     = "tag-"
+
+	// autoScaleProfileMetadataAutoprovisioned marks an AutoScaleVmProfile as
+	// having been created by cloudstackManager.createProfile, rather than by
+	// an operator through the CloudStack API directly. csNodeGroup.Delete
+	// refuses to remove an ASP without this marker. See
+	// csConfig.NodeGroupShapeTemplates.
+	autoScaleProfileMetadataAutoprovisioned = "autoprovisioned"
+
+	// The autoScaleProfileMetadata*Name constants let an operator give an
+	// AutoScaleVmProfile's project/zone/offering/template by human-readable
+	// name instead of the UUID the ASP itself requires, via
+	// byNameResolver.resolve. They use a "cluster-autoscaler/" prefix, unlike
+	// the other autoScaleProfileMetadata* keys, to read as an
+	// annotation-style key a CloudStack operator recognizes as
+	// cluster-autoscaler-specific rather than a CloudStack-native ASP field.
+	autoScaleProfileMetadataProjectName         = "cluster-autoscaler/project-name"
+	autoScaleProfileMetadataZoneName            = "cluster-autoscaler/zone-name"
+	autoScaleProfileMetadataServiceOfferingName = "cluster-autoscaler/service-offering-name"
+	autoScaleProfileMetadataTemplateName        = "cluster-autoscaler/template-name"
+
+	// autoScaleProfileMetadataZones lists, as a comma-separated ordered list
+	// of zone names, the failover zones csScaler.createVMAcrossZones tries a
+	// new VM in, in priority order. Additive to the ASP's own Zoneid/the
+	// single autoScaleProfileMetadataZoneName above - a profile without this
+	// key keeps deploying into its one zone exactly as before. See
+	// vmProfile.zoneNames.
+	autoScaleProfileMetadataZones = "cluster-autoscaler/zones"
+
+	// templateFilterExecutable is the only Template.ListTemplates
+	// templatefilter byNameResolver has a reason to use: the set of templates
+	// a node can actually be deployed from.
+	templateFilterExecutable = "executable"
+
+	// autoScaleProfileMetadataManagedExternallyBy marks a node group whose
+	// scale up/down must NOT go through csScaler's direct CloudStack
+	// create/destroy VM calls, because some other controller already owns
+	// that VM's lifecycle and would fight the autoscaler over it. Set by
+	// capiDiscoverer (value "capi"): a CAPI MachineDeployment's own
+	// controller reconciles its replica count against the Machines/VMs it
+	// created, so csNodeGroup.IncreaseSize/DeleteNodes refuse to run instead
+	// of silently deploying or destroying VMs CAPI doesn't know about. See
+	// vmProfile.managedExternallyBy.
+	autoScaleProfileMetadataManagedExternallyBy = "managedExternallyBy"
+
+	// managedExternallyByCAPI is the autoScaleProfileMetadataManagedExternallyBy
+	// value capiDiscoverer stamps onto every node group it discovers.
+	managedExternallyByCAPI = "capi"
+
+	nodeGroupVMTag = autoScaleProfileMetadataName
+)
+
+var requiredAutoScaleProfileMetadata = []string{
+	autoScaleProfileMetadataName,
+	autoScaleProfileMetadataMin,
+	autoScaleProfileMetadataMax,
+}
+
+// cloudstackManager keeps the state shared by every node group: the
+// discovered node groups themselves, the project cache and the scaler used
+// to create/destroy VMs. Refresh and Cleanup may run concurrently with the
+// autoscaler main loop calling IncreaseSize/DeleteNodes, so nodeGroups is
+// guarded by nodeGroupsMu and offeringPrices by offeringPricesMu.
+type cloudstackManager struct {
+	config       csConfig
+	client       cloudstackClient
+	apiTimeout   time.Duration
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+	nodeGroupsMu sync.RWMutex
+	nodeGroups   []csNodeGroup
+	projects     *projectCache
+	labelConfig  []labelAutoDiscoveryConfig
+	discoverers  []NodeGroupDiscoverer
+	scaler       *csScaler
+
+	// names memoizes project/zone/service-offering/template name-to-ID
+	// lookups driven by the autoScaleProfileMetadata*Name metadata keys, so
+	// refreshNodeGroupVms doesn't re-resolve the same name on every Refresh.
+	names *byNameResolver
+
+	// capabilities resolves, once, whether the connected CloudStack
+	// deployment is new enough to support the native AutoScaleVmGroup mode.
+	// See capabilityCheck.
+	capabilities *capabilityCheck
+
+	// offeringPrices caches the hourly price of every ServiceOffering seen
+	// so far, keyed by offering name, so csPricingModel doesn't need to hit
+	// the CloudStack API on every NodePrice call.
+	offeringPricesMu sync.RWMutex
+	offeringPrices   map[string]float64
+
+	// maxDriftedPerInterval bounds how many node groups' drifted VMs
+	// ReplaceDrifted replaces concurrently on each runDriftReplacementLoop
+	// tick.
+	maxDriftedPerInterval int
+
+	// utilization backs runConsolidationLoop's per-node CPU/memory request
+	// sums. Pluggable, like scaler.kubeClient, so it can be faked in tests.
+	utilization Utilization
+
+	// shapeTemplates maps a node group name to the vmProfile
+	// csNodeGroup.Create provisions an AutoScaleVmProfile from, built from
+	// config.NodeGroupShapeTemplates. A node group can only be
+	// autoprovisioned if its name has an entry here.
+	shapeTemplates map[string]vmProfile
+
+	// eventRecorderOnce builds recorder/eventRef the first time recordEvent
+	// is called. See eventRecorder.
+	eventRecorderOnce sync.Once
+	recorder          record.EventRecorder
+	eventRef          *apiv1.ObjectReference
+	eventRecorderErr  error
+}
+
+type cloudstackClient interface {
+	projectCloudstackClient
+	scalerCloudstackClient
+	ListAutoScaleVmProfiles(*cloudstack.ListAutoScaleVmProfilesParams) (*cloudstack.ListAutoScaleVmProfilesResponse, error)
+	ListResourceDetails(*cloudstack.ListResourceDetailsParams) (*cloudstack.ListResourceDetailsResponse, error)
+	ListVirtualMachines(*cloudstack.ListVirtualMachinesParams) (*cloudstack.ListVirtualMachinesResponse, error)
+	GetServiceOfferingByID(string, ...cloudstack.OptionFunc) (*cloudstack.ServiceOffering, int, error)
+	GetZoneByID(string, ...cloudstack.OptionFunc) (*cloudstack.Zone, int, error)
+	AddResourceDetail(*cloudstack.AddResourceDetailParams) (*cloudstack.AddResourceDetailResponse, error)
+	CreateAutoScaleVmProfile(*cloudstack.CreateAutoScaleVmProfileParams) (*cloudstack.CreateAutoScaleVmProfileResponse, error)
+	DeleteAutoScaleVmProfile(*cloudstack.DeleteAutoScaleVmProfileParams) (*cloudstack.DeleteAutoScaleVmProfileResponse, error)
+	nameResolverClient
+	capabilitiesClient
+}
+
+type aggregatedClient struct {
+	*cloudstack.AutoScaleService
+	*cloudstack.ResourcemetadataService
+	*cloudstack.VirtualMachineService
+	*cloudstack.ServiceOfferingService
+	*cloudstack.ZoneService
+	*cloudstack.ProjectService
+	*cloudstack.ResourcetagsService
+	*cloudstack.TemplateService
+	*cloudstack.ConfigurationService
+}
+
+type csConfig struct {
+	// APIKey is the key associated with the user account.
+	APIKey string `json:"api_key"`
+
+	// APISecret is the secret associated with the user account.
+	APISecret string `json:"api_secret"`
+
+	// InsecureSkipVerify points to Cloudstack API.
+	InsecureSkipVerify bool `json:"insecure"`
+
+	// UseProjects controls if node groups should be searched on all projects.
+	UseProjects bool `json:"use_projects"`
+
+	// ProjectRefreshInterval controls the refresh interval for existing projects list.
+	ProjectRefreshInterval string `json:"project_refresh_interval"`
+
+	// ProjectRefreshConcurrency bounds how many projects forEach processes in
+	// parallel on each Refresh. Defaults to defaultProjectRefreshConcurrency.
+	ProjectRefreshConcurrency int `json:"project_refresh_concurrency"`
+
+	// ProjectStaleCeiling is the hard limit on how old the project list
+	// forEach serves is allowed to get before it returns an error instead of
+	// stale data. Defaults to ProjectRefreshInterval times
+	// defaultStaleCeilingMultiplier.
+	ProjectStaleCeiling string `json:"project_stale_ceiling"`
+
+	// ExpungeVMs controls if the expunge flag should be set on delete.
+	ExpungeVMs bool `json:"expunge_vms"`
+
+	// ServiceOfferingPrices overrides the CloudStack-reported hourly price
+	// (the "price" ResourceDetail on a ServiceOffering) with an operator
+	// supplied table, keyed by ServiceOffering name. Useful when offerings
+	// aren't tagged with a price in CloudStack itself.
+	ServiceOfferingPrices map[string]float64 `json:"service_offering_prices"`
+
+	// APITimeout bounds every individual CloudStack API call, so a hung
+	// call can't block the autoscaler loop indefinitely.
+	APITimeout string `json:"api_timeout"`
+
+	// RequiredDaemonsets lists DaemonSets, as "namespace/name", that must
+	// have a Ready pod scheduled on a newly created node before it is
+	// considered to have finished joining the cluster. See ScaleUpTimeout.
+	RequiredDaemonsets []string `json:"required_daemonsets"`
+
+	// ScaleUpTimeout bounds how long IncreaseSize waits for a single new VM
+	// to become a Ready node (with every RequiredDaemonsets pod running on
+	// it) before giving up on that VM and emitting a Kubernetes Event.
+	// Defaults to defaultScaleUpTimeout.
+	ScaleUpTimeout string `json:"scale_up_timeout"`
+
+	// DriftReplacementInterval controls how often the background loop scans
+	// node groups for VMs whose nodeGroupProfileHashTag no longer matches
+	// their AutoScaleVmProfile and replaces them. Defaults to
+	// defaultDriftReplacementInterval.
+	DriftReplacementInterval string `json:"drift_replacement_interval"`
+
+	// MaxDriftedPerInterval bounds how many node groups' drifted VMs are
+	// replaced concurrently on each DriftReplacementInterval tick. Defaults
+	// to defaultMaxDriftedPerInterval.
+	MaxDriftedPerInterval int `json:"max_drifted_per_interval"`
+
+	// ConsolidationInterval controls how often the consolidation loop scans
+	// node groups for VMs it can remove beyond what the cluster-autoscaler's
+	// own scale-down already does. Defaults to
+	// defaultConsolidationInterval. Equivalent to a --consolidation-interval
+	// flag, expressed as config like every other interval in csConfig.
+	ConsolidationInterval string `json:"consolidation_interval"`
+
+	// ConsolidationThreshold is the target utilization (0-1) consolidation
+	// keeps the remaining VMs in a node group under after removing any.
+	// Defaults to defaultConsolidationThreshold.
+	ConsolidationThreshold float64 `json:"consolidation_threshold"`
+
+	// ScaleUpMaxConcurrency bounds how many DeployVirtualMachine/CreateTags
+	// calls scaleUp makes to CloudStack at once, so a large IncreaseSize
+	// doesn't slam the API all at once. Defaults to
+	// defaultScaleUpMaxConcurrency.
+	ScaleUpMaxConcurrency int `json:"scale_up_max_concurrency"`
+
+	// ScaleUpPerCallTimeout bounds a single VM's create-and-tag attempt,
+	// including retries. Defaults to defaultScaleUpPerCallTimeout.
+	ScaleUpPerCallTimeout string `json:"scale_up_per_call_timeout"`
+
+	// ScaleUpRetryMaxAttempts bounds how many times scaleUp retries a single
+	// VM's create-and-tag attempt after a transient CloudStack error (HTTP
+	// 429, 5xx, or a known transient CloudStack error code) before giving
+	// up on it. Defaults to defaultScaleUpRetryMaxAttempts.
+	ScaleUpRetryMaxAttempts int `json:"scale_up_retry_max_attempts"`
+
+	// ScaleUpRetryBaseDelay is the base of scaleUp's exponential backoff
+	// between retries (doubled each attempt, plus jitter, capped at
+	// defaultScaleUpRetryMaxDelay). Defaults to
+	// defaultScaleUpRetryBaseDelay.
+	ScaleUpRetryBaseDelay string `json:"scale_up_retry_base_delay"`
+
+	// ScaleUpRateLimitQPS caps the steady-state rate of
+	// DeployVirtualMachine/CreateTags calls scaleUp makes across every
+	// concurrent VM creation, guarding against CloudStack API quotas.
+	// Defaults to defaultScaleUpRateLimitQPS. A burst of
+	// ScaleUpMaxConcurrency is always permitted.
+	ScaleUpRateLimitQPS float64 `json:"scale_up_rate_limit_qps"`
+
+	// ManagementKubeconfig is the path to a kubeconfig for the Cluster API
+	// management cluster, required when a "capi" entry is present in
+	// NodeGroupAutoDiscoverySpecs. It is typically a different cluster than
+	// the one the autoscaler itself runs on.
+	ManagementKubeconfig string `json:"management_kubeconfig"`
+
+	// NodeGroupShapeTemplates declares, keyed by node group name, the
+	// AutoScaleVmProfile shapes csNodeGroup.Create may provision on demand
+	// when cluster-autoscaler needs a node shape that has no existing,
+	// discovered AutoScaleVmProfile backing it yet.
+	NodeGroupShapeTemplates map[string]NodeGroupShapeTemplate `json:"node_group_shape_templates"`
+
+	// EventObjectRef names the Kubernetes Namespace that NodeGroupCondition
+	// transitions (see csNodeGroup.Conditions) are recorded against, since a
+	// node group isn't itself a namespaced Kubernetes object. Defaults to
+	// defaultEventObjectRef.
+	EventObjectRef string `json:"event_object_ref"`
+
+	// URL points to Cloudstack API.
+	URL string `json:"url"`
+}
+
+var newCloudstackClient = func(cfg csConfig) cloudstackClient {
+	cs := cloudstack.NewAsyncClient(cfg.URL, cfg.APIKey, cfg.APISecret, !cfg.InsecureSkipVerify)
+
+	return aggregatedClient{
+		AutoScaleService:        cs.AutoScale,
+		ResourcemetadataService: cs.Resourcemetadata,
+		VirtualMachineService:   cs.VirtualMachine,
+		ServiceOfferingService:  cs.ServiceOffering,
+		ZoneService:             cs.Zone,
+		ProjectService:          cs.Project,
+		ResourcetagsService:     cs.Resourcetags,
+		TemplateService:         cs.Template,
+		ConfigurationService:    cs.Configuration,
+	}
+}
+
+func newManager(configReader io.Reader, do cloudprovider.NodeGroupDiscoveryOptions) (*cloudstackManager, error) {
+	cfg, err := loadConfig(configReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.APIKey == "" {
+		return nil, errors.New("api key is required")
+	}
+	if cfg.APISecret == "" {
+		return nil, errors.New("api secret is required")
+	}
+	if cfg.URL == "" {
+		return nil, errors.New("URL is required")
+	}
+
+	projectRefreshInterval := defaultProjectRefreshInterval
+	if cfg.ProjectRefreshInterval != "" {
+		var err error
+		projectRefreshInterval, err = time.ParseDuration(cfg.ProjectRefreshInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var projectStaleCeiling time.Duration
+	if cfg.ProjectStaleCeiling != "" {
+		var err error
+		projectStaleCeiling, err = time.ParseDuration(cfg.ProjectStaleCeiling)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	apiTimeout := defaultAPITimeout
+	if cfg.APITimeout != "" {
+		var err error
+		apiTimeout, err = time.ParseDuration(cfg.APITimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scaleUpTimeout := defaultScaleUpTimeout
+	if cfg.ScaleUpTimeout != "" {
+		var err error
+		scaleUpTimeout, err = time.ParseDuration(cfg.ScaleUpTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	driftReplacementInterval := defaultDriftReplacementInterval
+	if cfg.DriftReplacementInterval != "" {
+		var err error
+		driftReplacementInterval, err = time.ParseDuration(cfg.DriftReplacementInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxDriftedPerInterval := cfg.MaxDriftedPerInterval
+	if maxDriftedPerInterval <= 0 {
+		maxDriftedPerInterval = defaultMaxDriftedPerInterval
+	}
+
+	consolidationInterval := defaultConsolidationInterval
+	if cfg.ConsolidationInterval != "" {
+		var err error
+		consolidationInterval, err = time.ParseDuration(cfg.ConsolidationInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	consolidationThreshold := cfg.ConsolidationThreshold
+	if consolidationThreshold <= 0 {
+		consolidationThreshold = defaultConsolidationThreshold
+	}
+
+	scaleUpOpts := ScaleUpOptions{
+		MaxConcurrency: cfg.ScaleUpMaxConcurrency,
+		PerCallTimeout: defaultScaleUpPerCallTimeout,
+		Retry: RetryPolicy{
+			MaxAttempts: cfg.ScaleUpRetryMaxAttempts,
+			BaseDelay:   defaultScaleUpRetryBaseDelay,
+			MaxDelay:    defaultScaleUpRetryMaxDelay,
+		},
+	}
+	if scaleUpOpts.MaxConcurrency <= 0 {
+		scaleUpOpts.MaxConcurrency = defaultScaleUpMaxConcurrency
+	}
+	if cfg.ScaleUpPerCallTimeout != "" {
+		var err error
+		scaleUpOpts.PerCallTimeout, err = time.ParseDuration(cfg.ScaleUpPerCallTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if scaleUpOpts.Retry.MaxAttempts <= 0 {
+		scaleUpOpts.Retry.MaxAttempts = defaultScaleUpRetryMaxAttempts
+	}
+	if cfg.ScaleUpRetryBaseDelay != "" {
+		var err error
+		scaleUpOpts.Retry.BaseDelay, err = time.ParseDuration(cfg.ScaleUpRetryBaseDelay)
+		if err != nil {
+			return nil, err
+		}
+	}
+	scaleUpRateLimitQPS := cfg.ScaleUpRateLimitQPS
+	if scaleUpRateLimitQPS <= 0 {
+		scaleUpRateLimitQPS = defaultScaleUpRateLimitQPS
+	}
+	scaleUpOpts.RateLimiter = rate.NewLimiter(rate.Limit(scaleUpRateLimitQPS), scaleUpOpts.MaxConcurrency)
+
+	if !do.AutoDiscoverySpecified() {
+		return nil, errors.New("auto discovery configuration is required")
+	}
+
+	discoverySpecs, err := parseAutoDiscoverySpecs(do)
+	if err != nil {
+		return nil, err
+	}
+	labelConfig := discoverySpecs.label
+
+	shapeTemplates := make(map[string]vmProfile, len(cfg.NodeGroupShapeTemplates))
+	for name, template := range cfg.NodeGroupShapeTemplates {
+		shapeTemplates[name] = template.vmProfile(name)
+	}
+
+	cli := newCloudstackClient(cfg)
+
+	projects, err := newProjectCache(cli, cfg.UseProjects, projectRefreshInterval, projectStaleCeiling, cfg.ProjectRefreshConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	scaler, err := newCsScaler(cli, cfg.ExpungeVMs, cfg.RequiredDaemonsets, scaleUpTimeout, scaleUpOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := &cloudstackManager{
+		client:                cli,
+		config:                cfg,
+		apiTimeout:            apiTimeout,
+		ctx:                   ctx,
+		cancel:                cancel,
+		projects:              projects,
+		labelConfig:           labelConfig,
+		scaler:                scaler,
+		maxDriftedPerInterval: maxDriftedPerInterval,
+		shapeTemplates:        shapeTemplates,
+		names:                 newByNameResolver(cli),
+		capabilities:          newCapabilityCheck(cli),
+	}
+	m.utilization = &kubeUtilization{getKubeClient: m.scaler.getKubeClient}
+
+	primeCtx, primeCancel := m.callContext()
+	err = projects.Prime(primeCtx)
+	primeCancel()
+	if err != nil {
+		return nil, fmt.Errorf("priming project cache: %w", err)
+	}
+
+	if len(labelConfig) > 0 {
+		m.discoverers = append(m.discoverers, newResourceDetailDiscoverer(m, labelConfig))
+	}
+	for _, cfg := range discoverySpecs.crd {
+		informer, err := newCRDInformer(cfg.Namespace, ctx.Done())
+		if err != nil {
+			return nil, err
+		}
+		m.discoverers = append(m.discoverers, newCRDDiscoverer(m, cfg, informer))
+	}
+	if len(discoverySpecs.capi) > 0 {
+		mgmtClient, err := newManagementClient(cfg.ManagementKubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		for _, capiCfg := range discoverySpecs.capi {
+			m.discoverers = append(m.discoverers, newCAPIDiscoverer(m, capiCfg, mgmtClient))
+		}
+	}
+
+	m.wg.Add(1)
+	go m.runDriftReplacementLoop(driftReplacementInterval)
+
+	m.wg.Add(1)
+	go m.runConsolidationLoop(consolidationInterval, consolidationThreshold)
+
+	return m, nil
+}
+
+func loadConfig(configReader io.Reader) (csConfig, error) {
+	cfg := csConfig{}
+
+	if configReader != nil {
+		body, err := ioutil.ReadAll(configReader)
+		if err != nil {
+			return cfg, err
+		}
+		err = json.Unmarshal(body, &cfg)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	if v, ok := os.LookupEnv("CLOUDSTACK_API_KEY"); ok {
+		cfg.APIKey = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_API_SECRET"); ok {
+		cfg.APISecret = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_INSECURE"); ok {
+		cfg.InsecureSkipVerify, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_USE_PROJECTS"); ok {
+		cfg.UseProjects, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_PROJECT_REFRESH_INTERVAL"); ok {
+		cfg.ProjectRefreshInterval = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_PROJECT_REFRESH_CONCURRENCY"); ok {
+		cfg.ProjectRefreshConcurrency, _ = strconv.Atoi(v)
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_PROJECT_STALE_CEILING"); ok {
+		cfg.ProjectStaleCeiling = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_EXPUNGE_VMS"); ok {
+		cfg.ExpungeVMs, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_API_TIMEOUT"); ok {
+		cfg.APITimeout = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_SCALE_UP_TIMEOUT"); ok {
+		cfg.ScaleUpTimeout = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_DRIFT_REPLACEMENT_INTERVAL"); ok {
+		cfg.DriftReplacementInterval = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_MAX_DRIFTED_PER_INTERVAL"); ok {
+		cfg.MaxDriftedPerInterval, _ = strconv.Atoi(v)
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_CONSOLIDATION_INTERVAL"); ok {
+		cfg.ConsolidationInterval = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_CONSOLIDATION_THRESHOLD"); ok {
+		cfg.ConsolidationThreshold, _ = strconv.ParseFloat(v, 64)
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_SCALE_UP_MAX_CONCURRENCY"); ok {
+		cfg.ScaleUpMaxConcurrency, _ = strconv.Atoi(v)
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_SCALE_UP_PER_CALL_TIMEOUT"); ok {
+		cfg.ScaleUpPerCallTimeout = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_SCALE_UP_RETRY_MAX_ATTEMPTS"); ok {
+		cfg.ScaleUpRetryMaxAttempts, _ = strconv.Atoi(v)
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_SCALE_UP_RETRY_BASE_DELAY"); ok {
+		cfg.ScaleUpRetryBaseDelay = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_SCALE_UP_RATE_LIMIT_QPS"); ok {
+		cfg.ScaleUpRateLimitQPS, _ = strconv.ParseFloat(v, 64)
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_URL"); ok {
+		cfg.URL = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_MGMT_KUBECONFIG"); ok {
+		cfg.ManagementKubeconfig = v
+	}
+	if v, ok := os.LookupEnv("CLOUDSTACK_EVENT_OBJECT_REF"); ok {
+		cfg.EventObjectRef = v
+	}
+
+	return cfg, nil
+}
+
+// callContext derives a child of the manager's base context bounded by
+// apiTimeout, so a single hung CloudStack call can't block the scale loop
+// forever. The returned cancel func must always be called by the caller.
+// Callers that run in the background (e.g. async scale-up) should register
+// themselves on m.wg so Cleanup can wait for them to unwind.
+func (m *cloudstackManager) callContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(m.ctx, m.apiTimeout)
+}
+
+// Cleanup cancels the manager's base context, which unblocks any in-flight
+// CloudStack call bounded by callContext, and waits for the goroutines
+// registered on m.wg to drain, for at most defaultAPITimeout.
+func (m *cloudstackManager) Cleanup() error {
+	m.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(defaultAPITimeout):
+	}
+
+	return nil
+}
+
+// Refresh re-discovers node groups from every configured NodeGroupDiscoverer
+// and merges the results. A nodeGroupName claimed by more than one
+// discovered ASP (whether from the same discoverer or two different ones)
+// is treated as a misconfiguration and fails the whole refresh, same as
+// before discovery became pluggable.
+func (m *cloudstackManager) Refresh() error {
+	klog.V(4).Infof("native AutoScaleVmGroup support: %v", m.capabilities.nativeAutoScaleSupported())
+
+	var nodeGroups []csNodeGroup
+	registeredIds := make(map[string]string)
+
+	for _, discoverer := range m.discoverers {
+		found, err := discoverer.Discover()
+		if err != nil {
+			return err
+		}
+		for _, d := range found {
+			ng := csNodeGroup{
+				vmProfile: vmProfile{
+					asp:         d.asp,
+					aspMetadata: d.metadata,
+				},
+				manager: m,
+			}
+			if existingASPID, ok := registeredIds[ng.Id()]; ok {
+				return fmt.Errorf("more than one AutoScaleVMProfile with the nodeGroupName %q, ids: %v and %v", ng.Id(), d.asp.Id, existingASPID)
+			}
+			registeredIds[ng.Id()] = d.asp.Id
+			if err := m.refreshNodeGroupVms(&ng); err != nil {
+				return err
+			}
+			nodeGroups = append(nodeGroups, ng)
+		}
+	}
+
+	m.nodeGroupsMu.Lock()
+	m.nodeGroups = nodeGroups
+	m.nodeGroupsMu.Unlock()
+
+	return nil
+}
+
+func (m *cloudstackManager) getNodeGroups() []csNodeGroup {
+	m.nodeGroupsMu.RLock()
+	defer m.nodeGroupsMu.RUnlock()
+	return m.nodeGroups
+}
+
+// resolveNodeGroupZones resolves ng's cluster-autoscaler/zones metadata (see
+// vmProfile.zoneNames) into CloudStack zone IDs, in the same priority
+// order, and stores them as ng.vmProfile.zoneIDs for csScaler.scaleUp to
+// fail over across. A node group without that metadata is left untouched -
+// it keeps deploying into its single asp.Zoneid exactly as before
+// multi-zone support existed.
+func (m *cloudstackManager) resolveNodeGroupZones(ng *csNodeGroup) error {
+	names := ng.vmProfile.zoneNames()
+	if len(names) == 0 {
+		return nil
+	}
+	ids, err := m.names.resolveZones(names)
+	if err != nil {
+		return err
+	}
+	ng.vmProfile.zoneIDs = ids
+	if ng.vmProfile.asp.Zoneid == "" {
+		ng.vmProfile.asp.Zoneid = ids[0]
+	}
+	return nil
+}
+
+func (m *cloudstackManager) refreshNodeGroupVms(ng *csNodeGroup) error {
+	if err := m.names.resolve(&ng.vmProfile); err != nil {
+		return fmt.Errorf("resolving node group %q by-name metadata: %w", ng.Id(), err)
+	}
+	if err := m.resolveNodeGroupZones(ng); err != nil {
+		return fmt.Errorf("resolving node group %q failover zones: %w", ng.Id(), err)
+	}
+
+	var params cloudstack.ListVirtualMachinesParams
+	if projID := ng.vmProfile.projectID(); projID != "" {
+		params.SetProjectid(projID)
+	}
+	params.SetTags(map[string]string{
+		nodeGroupVMTag: ng.Id(),
+	})
+
+	vms, err := m.client.ListVirtualMachines(&params)
+	if err != nil {
+		return err
+	}
+	ng.vms = vms.VirtualMachines
+
+	offering, _, err := m.client.GetServiceOfferingByID(ng.vmProfile.asp.Serviceofferingid)
+	if err != nil {
+		return err
+	}
+	ng.vmProfile.offering = *offering
+
+	if err := m.cacheOfferingPrice(offering); err != nil {
+		klog.Errorf("failed to resolve price for service offering %q: %v", offering.Name, err)
+	}
+
+	zone, _, err := m.client.GetZoneByID(ng.vmProfile.asp.Zoneid)
+	if err != nil {
+		return err
+	}
+	ng.vmProfile.zone = *zone
+
+	ng.detectDrift()
+	recordNodeGroupSize(ng)
+
+	return nil
+}
+
+// cacheOfferingPrice resolves the hourly price of offering and stores it in
+// offeringPrices, keyed by offering name, so csPricingModel can look it up
+// without another API call. An operator-supplied entry in
+// ServiceOfferingPrices always wins; otherwise the "price" ResourceDetail
+// CloudStack reports for the offering is used. Offerings with neither are
+// left uncached, so NodePrice can surface a clear error instead of silently
+// pricing the node at 0.
+func (m *cloudstackManager) cacheOfferingPrice(offering *cloudstack.ServiceOffering) error {
+	if _, ok := m.offeringPrice(offering.Name); ok {
+		return nil
+	}
+
+	if price, ok := m.config.ServiceOfferingPrices[offering.Name]; ok {
+		m.setOfferingPrice(offering.Name, price)
+		return nil
+	}
+
+	var params cloudstack.ListResourceDetailsParams
+	params.SetResourcetype(resourceTypeServiceOffering)
+	params.SetResourceid(offering.Id)
+	details, err := m.client.ListResourceDetails(&params)
+	if err != nil {
+		return err
+	}
+
+	raw, ok := resourceDetailsToMetadata(details.ResourceDetails)[resourceDetailKeyPrice]
+	if !ok {
+		return nil
+	}
+	price, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return fmt.Errorf("parsing price resource detail %q: %w", raw, err)
+	}
+	m.setOfferingPrice(offering.Name, price)
+	return nil
+}
+
+// createProfile provisions a new AutoScaleVmProfile in CloudStack from
+// template (typically one of m.shapeTemplates) and tags it, via
+// AddResourceDetail, with template's aspMetadata plus the
+// autoScaleProfileMetadataAutoprovisioned marker - the same ResourceDetail
+// metadata the resourceDetailDiscoverer reads back on the next Refresh, so
+// the created ASP is picked up as a node group like any other. Used by
+// csNodeGroup.Create.
+func (m *cloudstackManager) createProfile(template vmProfile) (*cloudstack.AutoScaleVmProfile, error) {
+	var params cloudstack.CreateAutoScaleVmProfileParams
+	params.SetServiceofferingid(template.asp.Serviceofferingid)
+	params.SetTemplateid(template.asp.Templateid)
+	params.SetZoneid(template.asp.Zoneid)
+	if template.asp.Otherdeployparams != "" {
+		params.SetOtherdeployparams(template.asp.Otherdeployparams)
+	}
+
+	resp, err := m.client.CreateAutoScaleVmProfile(&params)
+	if err != nil {
+		return nil, fmt.Errorf("creating autoscale vm profile for node group %q: %w", template.Id(), err)
+	}
+
+	metadata := make(map[string]string, len(template.aspMetadata)+1)
+	for k, v := range template.aspMetadata {
+		metadata[k] = v
+	}
+	metadata[autoScaleProfileMetadataAutoprovisioned] = "true"
+
+	var detailParams cloudstack.AddResourceDetailParams
+	detailParams.SetResourcetype(resourceTypeAutoScaleVmProfile)
+	detailParams.SetResourceid(resp.Id)
+	detailParams.SetDetails(metadata)
+	if _, err := m.client.AddResourceDetail(&detailParams); err != nil {
+		return nil, fmt.Errorf("tagging autoscale vm profile %q for node group %q: %w", resp.Id, template.Id(), err)
+	}
+
+	return &cloudstack.AutoScaleVmProfile{
+		Id:                resp.Id,
+		Serviceofferingid: resp.Serviceofferingid,
+		Templateid:        resp.Templateid,
+		Zoneid:            resp.Zoneid,
+		Otherdeployparams: resp.Otherdeployparams,
+		Projectid:         resp.Projectid,
+	}, nil
+}
+
+// deleteProfile deletes the AutoScaleVmProfile identified by id. Used by
+// csNodeGroup.Delete, which is responsible for checking the ASP is both
+// autoprovisioned and free of VMs before calling it.
+func (m *cloudstackManager) deleteProfile(id string) error {
+	var params cloudstack.DeleteAutoScaleVmProfileParams
+	params.SetId(id)
+	_, err := m.client.DeleteAutoScaleVmProfile(&params)
+	return err
+}
+
+func (m *cloudstackManager) setOfferingPrice(offeringName string, price float64) {
+	m.offeringPricesMu.Lock()
+	defer m.offeringPricesMu.Unlock()
+	if m.offeringPrices == nil {
+		m.offeringPrices = map[string]float64{}
+	}
+	m.offeringPrices[offeringName] = price
+}
+
+func (m *cloudstackManager) offeringPrice(offeringName string) (float64, bool) {
+	m.offeringPricesMu.RLock()
+	defer m.offeringPricesMu.RUnlock()
+	price, ok := m.offeringPrices[offeringName]
+	return price, ok
+}
+
+// scaleUp creates toAddCount VMs for nodeGroup and returns their CloudStack
+// IDs. It deliberately doesn't wait for them to become Ready nodes - only
+// IncreaseSize's caller has a documented blocking contract; TargetSize's own
+// below-MinSize auto-correction (see csNodeGroup.TargetSize) also goes
+// through here and must stay cheap, since it's called on every poll.
+func (m *cloudstackManager) scaleUp(nodeGroup *csNodeGroup, toAddCount int) ([]string, error) {
+	if by := nodeGroup.vmProfile.managedExternallyBy(); by != "" {
+		return nil, fmt.Errorf("node group %q: %w (managed by %s)", nodeGroup.Id(), ErrNodeGroupManagedExternally, by)
+	}
+
+	m.wg.Add(1)
+	defer m.wg.Done()
+
+	nodeGroupScaleUpTotal.WithLabelValues(nodeGroup.Id()).Add(float64(toAddCount))
+
+	pending := nodeGroup.addPending(toAddCount)
+	defer nodeGroup.removePending(pending)
+
+	vmIDs, err := m.scaler.scaleUp(m.ctx, nodeGroup.vmProfile, toAddCount, pending)
+	if err != nil {
+		nodeGroupScaleUpFailedTotal.WithLabelValues(nodeGroup.Id()).Inc()
+		reason := NodeGroupProvisioningFailedReason
+		if errors.Is(err, ErrVMTaggingFailed) {
+			reason = NodeGroupTaggingFailedReason
+		}
+		nodeGroup.setCondition(NodeGroupDesiredReplicasCondition, apiv1.ConditionFalse, reason, err.Error())
+		return nil, err
+	}
+	if err := m.refreshNodeGroupVms(nodeGroup); err != nil {
+		return nil, err
+	}
+	nodeGroup.setCondition(NodeGroupDesiredReplicasCondition, apiv1.ConditionTrue, "",
+		fmt.Sprintf("reached target size after creating %d VM(s)", len(vmIDs)))
+
+	return vmIDs, nil
+}
+
+// cancelPendingVM abandons a single pendingVM p, as found by
+// csNodeGroup.cancelPending. If p's deployment hasn't produced a VM yet -
+// locally or, per csScaler.queryDeployJob, in CloudStack itself - cancelling
+// it is enough: createVM checks the same pendingVM before tagging and rolls
+// itself back. If it raced to completion, the VM it created is destroyed
+// the same way createVM rolls back its own failures, unless doing so would
+// drop the node group below MinSize, in which case the race is allowed to
+// stand and the VM is left for the next Refresh to pick up as a real node.
+func (m *cloudstackManager) cancelPendingVM(g *csNodeGroup, p *pendingVM) bool {
+	vmID, jobID := p.cancel()
+	if vmID == "" && jobID != "" {
+		var err error
+		vmID, _, err = m.scaler.queryDeployJob(jobID)
+		if err != nil {
+			klog.Errorf("node group %q: checking pending VM job %q before cancelling: %v", g.Id(), jobID, err)
+			return false
+		}
+	}
+	if vmID == "" {
+		return true
+	}
+	if len(g.vms) <= g.MinSize() {
+		klog.V(3).Infof("node group %q: pending VM %q finished deploying before it could be cancelled, keeping it to avoid dropping below MinSize", g.Id(), vmID)
+		return false
+	}
+	if err := m.scaler.destroyVM(g.Id(), vmID); err != nil {
+		klog.Errorf("node group %q: destroying cancelled pending VM %q: %v", g.Id(), vmID, err)
+		return false
+	}
+	return true
+}
+
+// waitForScaleUpComplete blocks until every VM in vmIDs is either a Ready
+// node (with all RequiredDaemonsets running on it) or has been waiting
+// longer than ScaleUpTimeout, so IncreaseSize doesn't return before the
+// autoscaler's view of the node group actually reflects usable capacity.
+// A VM that times out isn't treated as a hard failure: it may still join
+// later, so we only log and emit a Kubernetes Event for operators to chase.
+func (m *cloudstackManager) waitForScaleUpComplete(nodeGroup *csNodeGroup, vmIDs []string) {
+	var wg sync.WaitGroup
+	for _, vmID := range vmIDs {
+		wg.Add(1)
+		go func(vmID string) {
+			defer wg.Done()
+			m.waitForVMReady(nodeGroup, vmID)
+		}(vmID)
+	}
+	wg.Wait()
+}
+
+func (m *cloudstackManager) waitForVMReady(nodeGroup *csNodeGroup, vmID string) {
+	ctx, cancel := context.WithTimeout(m.ctx, m.scaler.scaleUpTimeout)
+	defer cancel()
+
+	providerID := nodeGroup.providerID(vmID)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		ready, err := m.scaler.ScaleUpComplete(ctx, providerID)
+		if err != nil {
+			klog.V(3).Infof("checking readiness of VM %q (node group %q): %v", vmID, nodeGroup.Id(), err)
+		} else if ready {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			klog.Errorf("VM %q (node group %q) did not become a ready node within %s", vmID, nodeGroup.Id(), m.scaler.scaleUpTimeout)
+			m.scaler.emitScaleUpTimeoutEvent(nodeGroup.Id(), providerID)
+			return
+		}
+	}
+}
+
+// runDriftReplacementLoop periodically replaces VMs whose AutoScaleVmProfile
+// has drifted since they were created. It runs until m.ctx is cancelled.
+func (m *cloudstackManager) runDriftReplacementLoop(interval time.Duration) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.ReplaceDrifted(m.ctx, m.maxDriftedPerInterval); err != nil {
+				klog.Errorf("failed to replace drifted VMs: %v", err)
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// ReplaceDrifted replaces one drifted VM per eligible node group, up to
+// maxConcurrent node groups at once: for each node group with at least one
+// drifted VM, more VMs than its MinSize, and room left in its disruption
+// budget (see GetAllowedDisruptions), it creates an up-to-date replacement
+// first and only destroys the drifted VM once that replacement exists,
+// Karpenter-style surge replacement. Unlike destroying the drifted VM and
+// relying on the autoscaler's regular scale-up to recreate it, this never
+// drops the node group below MinSize while remediating drift. Node groups
+// with no disruption budget left are skipped for this tick and retried on
+// the next one.
+func (m *cloudstackManager) ReplaceDrifted(ctx context.Context, maxConcurrent int) error {
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxDriftedPerInterval
+	}
+
+	// Only this pointer snapshot is taken under lock - replaceDriftedVM makes
+	// real CloudStack create/destroy calls, and holding nodeGroupsMu's write
+	// lock across those would stall every other reader of m.nodeGroups
+	// (notably getNodeGroups, polled every autoscaler loop) for as long as
+	// the slowest replacement takes. The *csNodeGroup pointers below are
+	// mutated directly - the same ones csCloudProvider.NodeGroups hands the
+	// autoscaler core itself - so no merge-back is needed; copying the
+	// csNodeGroup values instead would also copy their conditionsMu/pendingMu
+	// fields, leaving two locks guarding one shared slice.
+	m.nodeGroupsMu.RLock()
+	nodeGroups := make([]*csNodeGroup, len(m.nodeGroups))
+	for i := range m.nodeGroups {
+		nodeGroups[i] = &m.nodeGroups[i]
+	}
+	m.nodeGroupsMu.RUnlock()
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(maxConcurrent)
+
+	for _, ng := range nodeGroups {
+		ng := ng
+		if len(ng.driftedVMIDs) == 0 || len(ng.vms) <= ng.MinSize() {
+			continue
+		}
+		if allowed, err := ng.GetAllowedDisruptions(); err != nil || allowed <= 0 {
+			continue
+		}
+		var vmID string
+		for id := range ng.driftedVMIDs {
+			vmID = id
+			break
+		}
+
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return m.replaceDriftedVM(ng, vmID)
+		})
+	}
+
+	return g.Wait()
+}
+
+// replaceDriftedVM creates one up-to-date VM for ng's current vmProfile
+// and, only once that succeeds, destroys vmID.
+func (m *cloudstackManager) replaceDriftedVM(ng *csNodeGroup, vmID string) error {
+	tagsParams := createVMTagsParams(ng.vmProfile)
+	deployParams := createDeployVMParams(ng.vmProfile)
+	deployParams.SetName(m.scaler.randomName(ng.Id()))
+
+	newID, err := m.scaler.createVM(ng.Id(), deployParams, tagsParams, nil)
+	if err != nil {
+		return fmt.Errorf("creating replacement for drifted VM %q (node group %q): %w", vmID, ng.Id(), err)
+	}
+
+	if err := m.scaler.destroyVM(ng.Id(), vmID); err != nil {
+		return fmt.Errorf("destroying drifted VM %q (node group %q) after creating replacement %q: %w", vmID, ng.Id(), newID, err)
+	}
+
+	ng.removeVM(vmID)
+	delete(ng.driftedVMIDs, vmID)
+	recordNodeGroupSize(ng)
+	return nil
+}
+
+func (m *cloudstackManager) buildNode(nodeGroup *csNodeGroup) (*apiv1.Node, error) {
+	node := apiv1.Node{}
+	nodeName := m.scaler.randomName(nodeGroup.Id())
+
+	node.ObjectMeta = metav1.ObjectMeta{
+		Name:     nodeName,
+		SelfLink: fmt.Sprintf("/api/v1/nodes/%s", nodeName),
+		Labels:   map[string]string{},
+	}
+
+	node.Status = apiv1.NodeStatus{
+		Capacity: apiv1.ResourceList{},
+	}
+
+	node.Status.Capacity[apiv1.ResourcePods] = *resource.NewQuantity(110, resource.DecimalSI)
+	node.Status.Capacity[apiv1.ResourceCPU] = *resource.NewQuantity(int64(nodeGroup.vmProfile.offering.Cpunumber), resource.DecimalSI)
+	node.Status.Capacity[apiv1.ResourceMemory] = *resource.NewQuantity(int64(nodeGroup.vmProfile.offering.Memory)*1000*1000, resource.DecimalSI)
+	rootDiskSize := nodeGroup.vmProfile.rootDiskSize()
+	if rootDiskSize > 0 {
+		node.Status.Capacity[apiv1.ResourceEphemeralStorage] = *resource.NewQuantity(rootDiskSize*1024*1024*1024, resource.DecimalSI)
+	}
+	node.Status.Allocatable = node.Status.Capacity
+
+	node.Labels = cloudprovider.JoinStringMaps(node.Labels, nodeGroup.vmProfile.labels())
+	node.Labels = cloudprovider.JoinStringMaps(node.Labels, buildGenericLabels(nodeGroup))
+
+	node.Status.Conditions = cloudprovider.BuildReadyConditions()
+	return &node, nil
+}
+
+func buildGenericLabels(nodeGroup *csNodeGroup) map[string]string {
+	result := make(map[string]string)
+	result[kubeletapis.LabelArch] = cloudprovider.DefaultArch
+	result[kubeletapis.LabelOS] = cloudprovider.DefaultOS
+	result[apiv1.LabelInstanceType] = nodeGroup.vmProfile.offering.Name
+	result[apiv1.LabelZoneRegion] = nodeGroup.vmProfile.zone.Name
+	result[apiv1.LabelZoneFailureDomain] = nodeGroup.vmProfile.zone.Name
+	return result
+}
+
+func resourceDetailsToMetadata(details []*cloudstack.ResourceDetail) map[string]string {
+	metadata := map[string]string{}
+	for _, item := range details {
+		metadata[item.Key] = item.Value
+	}
+	return metadata
+}
+
+func vmTagsToMap(tags []cloudstack.Tags) map[string]string {
+	metadata := map[string]string{}
+	for _, tag := range tags {
+		metadata[tag.Key] = tag.Value
+	}
+	return metadata
+}
+
+func matchesLabelConfigs(metadata map[string]string, labels []labelAutoDiscoveryConfig) bool {
+	for _, labelSet := range labels {
+		if matchesSelector(metadata, labelSet.Selector) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesSelector(existing map[string]string, wanted map[string]string) bool {
+	for wantedKey, wantedValue := range wanted {
+		existingValue, ok := existing[wantedKey]
+		if !ok {
+			return false
+		}
+		if wantedValue != "" && existingValue != wantedValue {
+			return false
+		}
+	}
+	return true
+}
+
+type labelAutoDiscoveryConfig struct {
+	Selector map[string]string
+}
+
+func parseLabelAutoDiscoverySpec(spec string) (labelAutoDiscoveryConfig, error) {
+	cfg := labelAutoDiscoveryConfig{
+		Selector: make(map[string]string),
+	}
+
+	tokens := strings.Split(spec, ":")
+	if len(tokens) != 2 {
+		return cfg, fmt.Errorf("spec \"%s\" should be discoverer:key=value,key=value", spec)
+	}
+	discoverer := tokens[0]
+	if discoverer != autoDiscovererTypeLabel {
+		return cfg, fmt.Errorf("unsupported discoverer specified: %s", discoverer)
+	}
+
+	for _, arg := range strings.Split(tokens[1], ",") {
+		kv := strings.Split(arg, "=")
+		if len(kv) != 2 {
+			return cfg, fmt.Errorf("invalid key=value pair %s", kv)
+		}
+		k, v := kv[0], kv[1]
+		if k == "" || v == "" {
+			return cfg, fmt.Errorf("empty value not allowed in key=value tag pairs")
+		}
+		cfg.Selector[k] = v
+	}
+	return cfg, nil
+}
@@ -0,0 +1,449 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func Test_newManager(t *testing.T) {
+	cli := &fakeClient{}
+	newCloudstackClient = func(cfg csConfig) cloudstackClient {
+		return cli
+	}
+
+	tests := []struct {
+		configData    string
+		do            cloudprovider.NodeGroupDiscoveryOptions
+		expectedError string
+		envs          map[string]string
+	}{
+		{expectedError: `unexpected.*`},
+		{configData: `{}`, expectedError: `api key is required`},
+		{configData: `{
+			"api_key": "k1"
+		}`, expectedError: `api secret is required`},
+		{configData: `{
+			"api_key": "k1",
+			"api_secret": "s1"
+		}`, expectedError: `URL is required`},
+		{configData: `{
+			"api_key": "k1",
+			"api_secret": "s1",
+			"url": "u1"
+		}`, expectedError: `auto discovery configuration is required`},
+		{configData: `{
+			"api_key": "k1",
+			"api_secret": "s1",
+			"url": "u1"
+		}`, do: cloudprovider.NodeGroupDiscoveryOptions{
+			NodeGroupAutoDiscoverySpecs: []string{"invalid:a=b"},
+		}, expectedError: `unsupported discoverer specified: invalid`},
+		{configData: `{
+			"api_key": "k1",
+			"api_secret": "s1",
+			"url": "u1",
+			"api_timeout": "not-a-duration"
+		}`, do: cloudprovider.NodeGroupDiscoveryOptions{
+			NodeGroupAutoDiscoverySpecs: []string{"label:a=b"},
+		}, expectedError: `.*invalid duration.*`},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			for k, v := range tt.envs {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			mgr, err := newManager(strings.NewReader(tt.configData), tt.do)
+			if tt.expectedError != "" {
+				require.Error(t, err)
+				assert.Regexp(t, tt.expectedError, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, defaultAPITimeout, mgr.apiTimeout)
+		})
+	}
+}
+
+func Test_newManager_customAPITimeout(t *testing.T) {
+	cli := &fakeClient{}
+	newCloudstackClient = func(cfg csConfig) cloudstackClient {
+		return cli
+	}
+
+	mgr, err := newManager(strings.NewReader(`{
+		"api_key": "k1",
+		"api_secret": "s1",
+		"url": "u1",
+		"api_timeout": "5s"
+	}`), cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"label:a=b"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, mgr.apiTimeout)
+}
+
+func Test_cloudstackManager_Refresh(t *testing.T) {
+	cli := &fakeClient{}
+
+	cli.On("ListProjects", mock.Anything).Return(&cloudstack.ListProjectsResponse{
+		Count: 1,
+		Projects: []*cloudstack.Project{
+			{Id: "pj1"},
+		},
+	}, nil)
+
+	params := cloudstack.ListAutoScaleVmProfilesParams{}
+	cli.On("ListAutoScaleVmProfiles", &params).Return(&cloudstack.ListAutoScaleVmProfilesResponse{
+		Count: 0,
+	}, nil)
+
+	params2 := cloudstack.ListAutoScaleVmProfilesParams{}
+	params2.SetProjectid("pj1")
+	cli.On("ListAutoScaleVmProfiles", &params2).Return(&cloudstack.ListAutoScaleVmProfilesResponse{
+		Count: 1,
+		AutoScaleVmProfiles: []*cloudstack.AutoScaleVmProfile{
+			{Id: "asp1", Serviceofferingid: "offering1", Zoneid: "zone1"},
+		},
+	}, nil)
+
+	cli.On("ListResourceDetails", mock.Anything).Return(&cloudstack.ListResourceDetailsResponse{
+		Count: 1,
+		ResourceDetails: []*cloudstack.ResourceDetail{
+			{Key: "a", Value: "b"},
+			{Key: "nodeGroupName", Value: "ng1"},
+			{Key: "minNodes", Value: "0"},
+			{Key: "maxNodes", Value: "10"},
+		},
+	}, nil)
+
+	var listParams cloudstack.ListVirtualMachinesParams
+	listParams.SetTags(map[string]string{"nodeGroupName": "ng1"})
+	cli.On("ListVirtualMachines", &listParams).Return(&cloudstack.ListVirtualMachinesResponse{
+		Count: 1,
+		VirtualMachines: []*cloudstack.VirtualMachine{
+			{Id: "vm1"},
+		},
+	}, nil)
+	cli.On("GetServiceOfferingByID", "offering1").Return(&cloudstack.ServiceOffering{
+		Name: "offering1name",
+	}, 1, nil)
+	cli.On("GetZoneByID", "zone1").Return(&cloudstack.Zone{
+		Name: "zone1name",
+	}, 1, nil)
+
+	manager := &cloudstackManager{
+		client:     cli,
+		apiTimeout: time.Second,
+		ctx:        context.Background(),
+		projects: &projectCache{
+			client:      cli,
+			maxAge:      time.Hour,
+			useProjects: true,
+		},
+		scaler: &csScaler{
+			client: cli,
+		},
+		labelConfig: []labelAutoDiscoveryConfig{
+			{Selector: map[string]string{"a": "b"}},
+		},
+	}
+	manager.discoverers = []NodeGroupDiscoverer{newResourceDetailDiscoverer(manager, manager.labelConfig)}
+	err := manager.Refresh()
+	require.NoError(t, err)
+	cli.AssertExpectations(t)
+	assert.Len(t, manager.getNodeGroups(), 1)
+	assert.Equal(t, "ng1", manager.getNodeGroups()[0].Id())
+}
+
+// Test_cloudstackManager_Refresh_capiDiscoveredGroup confirms a
+// capiDiscoverer-found group resolves a real zone (from its required
+// capiZonesAnnotation) before refreshNodeGroupVms's GetZoneByID call, instead
+// of reaching it with an empty asp.Zoneid.
+func Test_cloudstackManager_Refresh_capiDiscoveredGroup(t *testing.T) {
+	cli := &fakeClient{}
+
+	scheme := runtime.NewScheme()
+	dynClient := fake.NewSimpleDynamicClientWithCustomListKinds(scheme, map[schema.GroupVersionResource]string{
+		machineDeploymentGVR:         "MachineDeploymentList",
+		cloudStackMachineTemplateGVR: "CloudStackMachineTemplateList",
+	})
+
+	md := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cluster.x-k8s.io/v1beta1",
+		"kind":       "MachineDeployment",
+		"metadata": map[string]interface{}{
+			"name":      "workers",
+			"namespace": "capi-system",
+			"labels":    map[string]interface{}{capiClusterNameLabel: "mycluster"},
+			"annotations": map[string]interface{}{
+				capiMinSizeAnnotation: "0",
+				capiMaxSizeAnnotation: "10",
+				capiZonesAnnotation:   "zone1",
+			},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"infrastructureRef": map[string]interface{}{"name": "workers-template"},
+				},
+			},
+		},
+	}}
+	tmpl := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "infrastructure.cluster.x-k8s.io/v1beta3",
+		"kind":       "CloudStackMachineTemplate",
+		"metadata": map[string]interface{}{
+			"name":      "workers-template",
+			"namespace": "capi-system",
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"offering": map[string]interface{}{"id": "offering1"},
+					"template": map[string]interface{}{"id": "template1"},
+				},
+			},
+		},
+	}}
+	_, err := dynClient.Resource(machineDeploymentGVR).Namespace("capi-system").Create(context.Background(), md, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = dynClient.Resource(cloudStackMachineTemplateGVR).Namespace("capi-system").Create(context.Background(), tmpl, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	var zoneParams cloudstack.ListZonesParams
+	zoneParams.SetName("zone1")
+	cli.On("ListZones", &zoneParams).Return(&cloudstack.ListZonesResponse{
+		Count: 1,
+		Zones: []*cloudstack.Zone{{Id: "zoneA", Name: "zone1"}},
+	}, nil)
+
+	var listParams cloudstack.ListVirtualMachinesParams
+	listParams.SetTags(map[string]string{"nodeGroupName": "workers"})
+	cli.On("ListVirtualMachines", &listParams).Return(&cloudstack.ListVirtualMachinesResponse{
+		Count: 1,
+		VirtualMachines: []*cloudstack.VirtualMachine{
+			{Id: "vm1"},
+		},
+	}, nil)
+	cli.On("GetServiceOfferingByID", "offering1").Return(&cloudstack.ServiceOffering{
+		Name: "offering1name",
+	}, 1, nil)
+	cli.On("ListResourceDetails", mock.Anything).Return(&cloudstack.ListResourceDetailsResponse{}, nil)
+	cli.On("GetZoneByID", "zoneA").Return(&cloudstack.Zone{
+		Name: "zone1",
+	}, 1, nil)
+
+	manager := &cloudstackManager{
+		client:     cli,
+		apiTimeout: time.Second,
+		ctx:        context.Background(),
+		names:      newByNameResolver(cli),
+		scaler: &csScaler{
+			client: cli,
+		},
+	}
+	manager.discoverers = []NodeGroupDiscoverer{newCAPIDiscoverer(manager, capiAutoDiscoveryConfig{Namespace: "capi-system", ClusterName: "mycluster"}, dynClient)}
+
+	err = manager.Refresh()
+	require.NoError(t, err)
+	cli.AssertExpectations(t)
+	require.Len(t, manager.getNodeGroups(), 1)
+	assert.Equal(t, "workers", manager.getNodeGroups()[0].Id())
+	assert.Equal(t, "zoneA", manager.getNodeGroups()[0].vmProfile.asp.Zoneid)
+}
+
+func Test_cloudstackManager_Cleanup(t *testing.T) {
+	cli := &fakeClient{}
+	newCloudstackClient = func(cfg csConfig) cloudstackClient {
+		return cli
+	}
+	mgr, err := newManager(strings.NewReader(`{
+		"api_key": "k1",
+		"api_secret": "s1",
+		"url": "u1"
+	}`), cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{"label:a=b"},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, mgr.Cleanup())
+	assert.Error(t, mgr.ctx.Err())
+}
+
+func Test_cloudstackManager_cacheOfferingPrice_configOverride(t *testing.T) {
+	cli := &fakeClient{}
+	manager := &cloudstackManager{
+		client: cli,
+		config: csConfig{
+			ServiceOfferingPrices: map[string]float64{"offering1name": 0.25},
+		},
+	}
+
+	err := manager.cacheOfferingPrice(&cloudstack.ServiceOffering{Id: "offering1", Name: "offering1name"})
+	require.NoError(t, err)
+	cli.AssertNotCalled(t, "ListResourceDetails", mock.Anything)
+
+	price, ok := manager.offeringPrice("offering1name")
+	require.True(t, ok)
+	assert.Equal(t, 0.25, price)
+}
+
+func Test_cloudstackManager_cacheOfferingPrice_resourceDetail(t *testing.T) {
+	cli := &fakeClient{}
+	params := cloudstack.ListResourceDetailsParams{}
+	params.SetResourcetype(resourceTypeServiceOffering)
+	params.SetResourceid("offering1")
+	cli.On("ListResourceDetails", &params).Return(&cloudstack.ListResourceDetailsResponse{
+		ResourceDetails: []*cloudstack.ResourceDetail{
+			{Key: resourceDetailKeyPrice, Value: "0.4"},
+		},
+	}, nil)
+
+	manager := &cloudstackManager{client: cli}
+
+	err := manager.cacheOfferingPrice(&cloudstack.ServiceOffering{Id: "offering1", Name: "offering1name"})
+	require.NoError(t, err)
+	cli.AssertExpectations(t)
+
+	price, ok := manager.offeringPrice("offering1name")
+	require.True(t, ok)
+	assert.Equal(t, 0.4, price)
+}
+
+func Test_cloudstackManager_resolveNodeGroupZones(t *testing.T) {
+	cli := &fakeClient{}
+
+	zoneAParams := cloudstack.ListZonesParams{}
+	zoneAParams.SetName("zone-a")
+	cli.On("ListZones", &zoneAParams).Return(&cloudstack.ListZonesResponse{
+		Zones: []*cloudstack.Zone{{Id: "zoneA"}},
+	}, nil)
+
+	zoneBParams := cloudstack.ListZonesParams{}
+	zoneBParams.SetName("zone-b")
+	cli.On("ListZones", &zoneBParams).Return(&cloudstack.ListZonesResponse{
+		Zones: []*cloudstack.Zone{{Id: "zoneB"}},
+	}, nil)
+
+	manager := &cloudstackManager{client: cli, names: newByNameResolver(cli)}
+	ng := &csNodeGroup{vmProfile: vmProfile{
+		aspMetadata: map[string]string{autoScaleProfileMetadataZones: "zone-a,zone-b"},
+	}}
+
+	require.NoError(t, manager.resolveNodeGroupZones(ng))
+	assert.Equal(t, []string{"zoneA", "zoneB"}, ng.vmProfile.zoneIDs)
+	assert.Equal(t, "zoneA", ng.vmProfile.asp.Zoneid, "the first failover zone fills the single-zone field used elsewhere")
+}
+
+func Test_cloudstackManager_resolveNodeGroupZones_noMetadataIsANoop(t *testing.T) {
+	cli := &fakeClient{}
+	manager := &cloudstackManager{client: cli, names: newByNameResolver(cli)}
+	ng := &csNodeGroup{vmProfile: vmProfile{asp: cloudstack.AutoScaleVmProfile{Zoneid: "zone1"}}}
+
+	require.NoError(t, manager.resolveNodeGroupZones(ng))
+	assert.Nil(t, ng.vmProfile.zoneIDs)
+	assert.Equal(t, "zone1", ng.vmProfile.asp.Zoneid)
+}
+
+func Test_cloudstackManager_createProfile(t *testing.T) {
+	cli := &fakeClient{}
+	cli.On("CreateAutoScaleVmProfile", mock.Anything).Return(&cloudstack.CreateAutoScaleVmProfileResponse{
+		Id:                "asp1",
+		Serviceofferingid: "offering1",
+		Templateid:        "template1",
+		Zoneid:            "zone1",
+	}, nil)
+
+	var detailParams cloudstack.AddResourceDetailParams
+	detailParams.SetResourcetype(resourceTypeAutoScaleVmProfile)
+	detailParams.SetResourceid("asp1")
+	detailParams.SetDetails(map[string]string{
+		autoScaleProfileMetadataName:            "ng1",
+		autoScaleProfileMetadataMin:             "1",
+		autoScaleProfileMetadataMax:             "5",
+		autoScaleProfileMetadataAutoprovisioned: "true",
+	})
+	cli.On("AddResourceDetail", &detailParams).Return(&cloudstack.AddResourceDetailResponse{}, nil)
+
+	manager := &cloudstackManager{client: cli}
+	template := NodeGroupShapeTemplate{
+		ServiceOfferingID: "offering1",
+		TemplateID:        "template1",
+		ZoneID:            "zone1",
+		MinSize:           1,
+		MaxSize:           5,
+	}.vmProfile("ng1")
+
+	asp, err := manager.createProfile(template)
+	require.NoError(t, err)
+	cli.AssertExpectations(t)
+	assert.Equal(t, "asp1", asp.Id)
+	assert.Equal(t, "offering1", asp.Serviceofferingid)
+}
+
+func Test_cloudstackManager_createProfile_apiError(t *testing.T) {
+	cli := &fakeClient{}
+	cli.On("CreateAutoScaleVmProfile", mock.Anything).Return((*cloudstack.CreateAutoScaleVmProfileResponse)(nil), assert.AnError)
+
+	manager := &cloudstackManager{client: cli}
+	template := NodeGroupShapeTemplate{}.vmProfile("ng1")
+
+	_, err := manager.createProfile(template)
+	require.Error(t, err)
+}
+
+func Test_cloudstackManager_deleteProfile(t *testing.T) {
+	cli := &fakeClient{}
+	var params cloudstack.DeleteAutoScaleVmProfileParams
+	params.SetId("asp1")
+	cli.On("DeleteAutoScaleVmProfile", &params).Return(&cloudstack.DeleteAutoScaleVmProfileResponse{}, nil)
+
+	manager := &cloudstackManager{client: cli}
+	require.NoError(t, manager.deleteProfile("asp1"))
+	cli.AssertExpectations(t)
+}
+
+func Test_cloudstackManager_cacheOfferingPrice_noPriceAvailable(t *testing.T) {
+	cli := &fakeClient{}
+	cli.On("ListResourceDetails", mock.Anything).Return(&cloudstack.ListResourceDetailsResponse{}, nil)
+
+	manager := &cloudstackManager{client: cli}
+
+	err := manager.cacheOfferingPrice(&cloudstack.ServiceOffering{Id: "offering1", Name: "offering1name"})
+	require.NoError(t, err)
+
+	_, ok := manager.offeringPrice("offering1name")
+	assert.False(t, ok)
+}
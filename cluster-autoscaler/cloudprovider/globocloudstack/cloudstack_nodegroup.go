@@ -17,8 +17,10 @@ limitations under the License.
 package globocloudstack
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/xanzy/go-cloudstack/v2/cloudstack"
 	apiv1 "k8s.io/api/core/v1"
@@ -28,10 +30,49 @@ import (
 	schedulerframework "k8s.io/kubernetes/pkg/scheduler/framework"
 )
 
+// ErrNoShapeTemplate is returned by csNodeGroup.Create when no
+// NodeGroupShapeTemplate is configured for the node group's name.
+var ErrNoShapeTemplate = errors.New("no shape template configured for node group")
+
+// ErrNodeGroupNotAutoprovisioned is returned by csNodeGroup.Delete when the
+// node group's AutoScaleVmProfile wasn't created by cloudstackManager.createProfile.
+var ErrNodeGroupNotAutoprovisioned = errors.New("node group was not autoprovisioned by cluster-autoscaler")
+
+// ErrNodeGroupHasVMs is returned by csNodeGroup.Delete when the node group
+// still has VMs attached.
+var ErrNodeGroupHasVMs = errors.New("node group still has VMs attached")
+
+// ErrNodeGroupManagedExternally is returned by csNodeGroup.IncreaseSize and
+// DeleteNodes (via cloudstackManager.scaleUp for the former) when the node
+// group's vmProfile.managedExternallyBy is set - e.g. a capiDiscoverer
+// group, whose Machine/MachineSet controller owns its VMs' lifecycle and
+// would fight the autoscaler over any VM created or destroyed directly
+// against the CloudStack API instead of through it.
+var ErrNodeGroupManagedExternally = errors.New("node group is managed externally and cannot be scaled directly")
+
 type csNodeGroup struct {
 	manager   *cloudstackManager
 	vmProfile vmProfile
 	vms       []*cloudstack.VirtualMachine
+
+	// driftedVMIDs maps the ID of every vm whose nodeGroupProfileHashTag no
+	// longer matches vmProfile.driftHash() to the stable reason code
+	// (ServiceOfferingDrift, TemplateDrift, ...) that detectDrift attributed
+	// the mismatch to, as of the last detectDrift call. A VM without the tag
+	// at all (created before drift detection existed) is treated as not
+	// drifted, not as unconditionally drifted.
+	driftedVMIDs map[string]string
+
+	// conditions backs Conditions(), updated by setCondition from
+	// IncreaseSize, DeleteNodes and manager.scaleUp. See NodeGroupCondition.
+	conditionsMu sync.Mutex
+	conditions   []NodeGroupCondition
+
+	// pending tracks manager.scaleUp's in-flight VM deployments for this
+	// node group, so TargetSize can count them and DecreaseTargetSize can
+	// cancel them. See pendingVM.
+	pendingMu sync.Mutex
+	pending   []*pendingVM
 }
 
 // MaxSize returns maximum size of the node group.
@@ -48,16 +89,21 @@ func (g *csNodeGroup) MinSize() int {
 // number of nodes in Kubernetes is different at the moment but should be equal
 // to Size() once everything stabilizes (new nodes finish startup and registration or
 // removed nodes are deleted completely). Implementation required.
+//
+// The real VM count alone would undercount a node group mid scale-up: it
+// counts every VM manager.scaleUp is still deploying (see pendingVM) as
+// claimed capacity too, so a slow or stuck CloudStack job doesn't make this
+// node group look smaller than it actually is.
 func (g *csNodeGroup) TargetSize() (int, error) {
-	targetSize := len(g.vms)
+	targetSize := len(g.vms) + g.pendingCount()
 	minSize := g.MinSize()
 
 	if targetSize < minSize {
-		err := g.manager.scaleUp(g, minSize-targetSize)
+		_, err := g.manager.scaleUp(g, minSize-targetSize)
 		if err != nil {
 			klog.Errorf("failed to scale-up group %q to min-size: %v", g.vmProfile.Id(), err)
 		}
-		targetSize = len(g.vms)
+		targetSize = len(g.vms) + g.pendingCount()
 	}
 
 	return targetSize, nil
@@ -82,24 +128,61 @@ func (g *csNodeGroup) IncreaseSize(delta int) error {
 			currentSize, targetSize, g.MaxSize())
 	}
 
-	return g.manager.scaleUp(g, delta)
+	g.setCondition(NodeGroupDesiredReplicasCondition, apiv1.ConditionFalse, NodeGroupScalingUpReason,
+		fmt.Sprintf("scaling up by %d VM(s) to reach target size %d", delta, targetSize))
+
+	vmIDs, err := g.manager.scaleUp(g, delta)
+	if err != nil {
+		return err
+	}
+	// Only IncreaseSize has a documented blocking contract ("should wait
+	// until node group size is updated") - TargetSize's own below-MinSize
+	// auto-correction shares manager.scaleUp but must stay a cheap,
+	// non-blocking accessor, so the wait lives here instead of inside
+	// scaleUp itself.
+	g.manager.waitForScaleUpComplete(g, vmIDs)
+	return nil
 }
 
 // DeleteNodes deletes nodes from this node group. Error is returned either on
 // failure or if the given node doesn't belong to this node group. This function
 // should wait until node group size is updated. Implementation required.
+//
+// Before deleting anything it checks the node group's disruption budget
+// (see GetAllowedDisruptions): if deleting every node in nodes would disrupt
+// more VMs than currently allowed, it rejects the whole batch with
+// ErrDisruptionBudgetExceeded instead of deleting part of it.
 func (g *csNodeGroup) DeleteNodes(nodes []*apiv1.Node) error {
+	if by := g.vmProfile.managedExternallyBy(); by != "" {
+		return fmt.Errorf("node group %q: %w (managed by %s)", g.Id(), ErrNodeGroupManagedExternally, by)
+	}
+
+	allowed, err := g.GetAllowedDisruptions()
+	if err != nil {
+		return err
+	}
+	if len(nodes) > allowed {
+		return fmt.Errorf("deleting %d node(s) from node group %q: %w (allowed: %d)", len(nodes), g.Id(), ErrDisruptionBudgetExceeded, allowed)
+	}
+
+	g.setCondition(NodeGroupDesiredReplicasCondition, apiv1.ConditionFalse, NodeGroupScalingDownReason,
+		fmt.Sprintf("scaling down by %d VM(s)", len(nodes)))
+
 	for _, n := range nodes {
 		vm, err := g.vmForNode(n)
 		if err != nil {
 			return err
 		}
-		err = g.manager.scaler.destroyVM(vm.Id)
+		err = g.manager.scaler.destroyVM(g.Id(), vm.Id)
 		if err != nil {
 			return err
 		}
 		g.removeVM(vm.Id)
+		nodeGroupDestroyTotal.WithLabelValues(g.Id()).Inc()
 	}
+	recordNodeGroupSize(g)
+	g.setCondition(NodeGroupDesiredReplicasCondition, apiv1.ConditionTrue, "",
+		fmt.Sprintf("reached target size after destroying %d VM(s)", len(nodes)))
 	return nil
 }
 
@@ -108,7 +191,19 @@ func (g *csNodeGroup) DeleteNodes(nodes []*apiv1.Node) error {
 // request for new nodes that have not been yet fulfilled. Delta should be negative.
 // It is assumed that cloud provider will not delete the existing nodes when there
 // is an option to just decrease the target. Implementation required.
+//
+// It cancels up to -delta of this node group's most recently started
+// pending VM deployments (see pendingVM), so a slow or stuck scale-up can be
+// taken back before its VMs ever count as real capacity. It never touches
+// an existing node, except for the narrow race where a deployment finishes
+// between being cancelled and that cancellation being observed - see
+// cloudstackManager.cancelPendingVM for how that's resolved without ever
+// letting the node group's real VM count drop below MinSize.
 func (g *csNodeGroup) DecreaseTargetSize(delta int) error {
+	if delta >= 0 {
+		return fmt.Errorf("delta must be negative, have: %d", delta)
+	}
+	g.cancelPending(-delta)
 	return nil
 }
 
@@ -125,17 +220,84 @@ func (g *csNodeGroup) Debug() string {
 // Nodes returns a list of all nodes that belong to this node group.
 // It is required that Instance objects returned by this method have Id field set.
 // Other fields are optional.
+//
+// jobCache is scoped to this one call, so querying every VM's async job (see
+// csScaler.instanceStatus) never asks CloudStack about the same job twice
+// within a single reconcile pass, but also never serves another pass a
+// stale answer.
 func (g *csNodeGroup) Nodes() ([]cloudprovider.Instance, error) {
+	jobCache := map[string]*cloudstack.QueryAsyncJobResultResponse{}
 	var instances []cloudprovider.Instance
 	for _, vm := range g.vms {
 		instances = append(instances, cloudprovider.Instance{
 			Id:     g.providerID(vm.Id),
-			Status: toInstanceStatus(vm.State),
+			Status: g.manager.scaler.instanceStatus(vm, jobCache),
 		})
 	}
 	return instances, nil
 }
 
+// Drifted returns the instances backed by a VM whose nodeGroupProfileHashTag
+// no longer matches this node group's AutoScaleVmProfile, as computed by the
+// last detectDrift call. It mirrors Nodes, except every returned Instance
+// carries an ErrorInfo whose ErrorCode is the specific driftCategory reason
+// (e.g. ServiceOfferingDrift, TemplateDrift) detectDrift attributed the
+// mismatch to, so callers (and ReplaceDrifted) can tell drifted instances
+// apart from healthy ones and report why.
+func (g *csNodeGroup) Drifted() []cloudprovider.Instance {
+	var instances []cloudprovider.Instance
+	for vmID, reason := range g.driftedVMIDs {
+		instances = append(instances, cloudprovider.Instance{
+			Id: g.providerID(vmID),
+			Status: &cloudprovider.InstanceStatus{
+				State: cloudprovider.InstanceRunning,
+				ErrorInfo: &cloudprovider.InstanceErrorInfo{
+					ErrorClass:   cloudprovider.OtherErrorClass,
+					ErrorCode:    reason,
+					ErrorMessage: fmt.Sprintf("VM %q no longer matches node group %q's AutoScaleVmProfile (%s) and is pending replacement", vmID, g.Id(), reason),
+				},
+			},
+		})
+	}
+	return instances
+}
+
+// detectDrift recomputes which of this node group's vms no longer match its
+// current vmProfile.driftHash(), by comparing against the
+// nodeGroupProfileHashTag each VM was tagged with at creation. It is called
+// by refreshNodeGroupVms after vms/vmProfile are (re)populated.
+func (g *csNodeGroup) detectDrift() {
+	currentHash := g.vmProfile.driftHash()
+
+	drifted := map[string]string{}
+	for _, vm := range g.vms {
+		vmTags := vmTagsToMap(vm.Tags)
+		hash, ok := vmTags[nodeGroupProfileHashTag]
+		if !ok || hash == currentHash {
+			continue
+		}
+		drifted[vm.Id] = g.driftReason(vmTags)
+	}
+	g.driftedVMIDs = drifted
+}
+
+// driftReason pinpoints which driftCategory caused a VM to be considered
+// drifted, by comparing its per-category tags (stamped by
+// createVMTagsParams) against the node group's current profile. Categories
+// are checked in driftCategories order, so a VM that has drifted in more
+// than one category always reports the same reason. A VM created before
+// per-category tagging existed - or missing a given category's tag for any
+// other reason - falls back to the generic VMProfileDrift code.
+func (g *csNodeGroup) driftReason(vmTags map[string]string) string {
+	for _, c := range driftCategories {
+		tagValue, ok := vmTags[c.tag]
+		if ok && tagValue != c.hash(&g.vmProfile) {
+			return c.reason
+		}
+	}
+	return "VMProfileDrift"
+}
+
 // TemplateNodeInfo returns a schedulernodeinfo.NodeInfo structure of an empty
 // (as if just started) node. This will be used in scale-up simulations to
 // predict what would a new node look like if a node group was expanded. The returned
@@ -159,22 +321,49 @@ func (g *csNodeGroup) Exist() bool {
 	return true
 }
 
-// Create creates the node group on the cloud provider side. Implementation optional.
+// Create creates the node group on the cloud provider side, by provisioning
+// a new AutoScaleVmProfile from the NodeGroupShapeTemplate registered under
+// this node group's name. Implementation optional.
 func (g *csNodeGroup) Create() (cloudprovider.NodeGroup, error) {
-	return nil, cloudprovider.ErrNotImplemented
+	template, ok := g.manager.shapeTemplates[g.Id()]
+	if !ok {
+		return nil, fmt.Errorf("node group %q: %w", g.Id(), ErrNoShapeTemplate)
+	}
+
+	asp, err := g.manager.createProfile(template)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string, len(template.aspMetadata)+1)
+	for k, v := range template.aspMetadata {
+		metadata[k] = v
+	}
+	metadata[autoScaleProfileMetadataAutoprovisioned] = "true"
+
+	template.asp = *asp
+	template.aspMetadata = metadata
+	g.vmProfile = template
+	return g, nil
 }
 
 // Delete deletes the node group on the cloud provider side.
 // This will be executed only for autoprovisioned node groups, once their size drops to 0.
 // Implementation optional.
 func (g *csNodeGroup) Delete() error {
-	return cloudprovider.ErrNotImplemented
+	if !g.Autoprovisioned() {
+		return fmt.Errorf("node group %q: %w", g.Id(), ErrNodeGroupNotAutoprovisioned)
+	}
+	if len(g.vms) > 0 {
+		return fmt.Errorf("node group %q has %d VM(s) attached: %w", g.Id(), len(g.vms), ErrNodeGroupHasVMs)
+	}
+	return g.manager.deleteProfile(g.vmProfile.asp.Id)
 }
 
 // Autoprovisioned returns true if the node group is autoprovisioned. An autoprovisioned group
 // was created by CA and can be deleted when scaled to 0.
 func (g *csNodeGroup) Autoprovisioned() bool {
-	return false
+	return g.vmProfile.autoprovisioned()
 }
 
 func (g *csNodeGroup) removeVM(vmID string) {
@@ -204,30 +393,3 @@ func (g *csNodeGroup) providerID(vmID string) string {
 func (g *csNodeGroup) GetOptions(defaults config.NodeGroupAutoscalingOptions) (*config.NodeGroupAutoscalingOptions, error) {
 	return nil, cloudprovider.ErrNotImplemented
 }
-
-func toInstanceStatus(csState string) *cloudprovider.InstanceStatus {
-	// Possible states from https://github.com/apache/cloudstack/blob/87c43501608a1df72a2f01ed17a522233e6617b0/api/src/main/java/com/cloud/vm/VirtualMachine.java#L45
-
-	var state cloudprovider.InstanceState
-	var err *cloudprovider.InstanceErrorInfo
-
-	switch csState {
-	case "Starting", "Migrating":
-		state = cloudprovider.InstanceCreating
-	case "Running":
-		state = cloudprovider.InstanceRunning
-	case "Stopping", "Stopped", "Destroyed", "Expunging", "Shutdowned":
-		state = cloudprovider.InstanceDeleting
-	default:
-		err = &cloudprovider.InstanceErrorInfo{
-			ErrorClass:   cloudprovider.OtherErrorClass,
-			ErrorCode:    "",
-			ErrorMessage: fmt.Sprintf("unexpected vm state: %v", csState),
-		}
-	}
-
-	return &cloudprovider.InstanceStatus{
-		State:     state,
-		ErrorInfo: err,
-	}
-}
@@ -0,0 +1,292 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_csNodeGroup_detectDrift(t *testing.T) {
+	profile := baseVMProfile()
+	currentHash := profile.driftHash()
+
+	ng := csNodeGroup{
+		vmProfile: profile,
+		vms: []*cloudstack.VirtualMachine{
+			{Id: "vm-matching", Tags: []cloudstack.Tags{{Key: nodeGroupProfileHashTag, Value: currentHash}}},
+			{Id: "vm-untagged"},
+			{Id: "vm-drifted-no-category-tags", Tags: []cloudstack.Tags{{Key: nodeGroupProfileHashTag, Value: "stale-hash"}}},
+			{Id: "vm-offering-drifted", Tags: []cloudstack.Tags{
+				{Key: nodeGroupProfileHashTag, Value: "stale-hash"},
+				{Key: nodeGroupOfferingHashTag, Value: "stale-offering-hash"},
+			}},
+		},
+	}
+
+	ng.detectDrift()
+
+	assert.Equal(t, map[string]string{
+		"vm-drifted-no-category-tags": "VMProfileDrift",
+		"vm-offering-drifted":         "ServiceOfferingDrift",
+	}, ng.driftedVMIDs)
+}
+
+func Test_csNodeGroup_Drifted(t *testing.T) {
+	ng := csNodeGroup{
+		vmProfile:    baseVMProfile(),
+		driftedVMIDs: map[string]string{"vm-drifted": "TemplateDrift"},
+	}
+	ng.vmProfile.aspMetadata[autoScaleProfileMetadataProviderIDPrefix] = "cloudstack://"
+
+	instances := ng.Drifted()
+
+	assert.Len(t, instances, 1)
+	assert.Equal(t, "cloudstack://vm-drifted", instances[0].Id)
+	assert.NotNil(t, instances[0].Status.ErrorInfo)
+	assert.Equal(t, "TemplateDrift", instances[0].Status.ErrorInfo.ErrorCode)
+}
+
+func Test_csNodeGroup_Drifted_none(t *testing.T) {
+	ng := csNodeGroup{vmProfile: baseVMProfile()}
+	assert.Empty(t, ng.Drifted())
+}
+
+func Test_csNodeGroup_Create(t *testing.T) {
+	cli := &fakeClient{}
+	cli.On("CreateAutoScaleVmProfile", mock.Anything).Return(&cloudstack.CreateAutoScaleVmProfileResponse{
+		Id:                "asp1",
+		Serviceofferingid: "offering1",
+		Templateid:        "template1",
+		Zoneid:            "zone1",
+	}, nil)
+	cli.On("AddResourceDetail", mock.Anything).Return(&cloudstack.AddResourceDetailResponse{}, nil)
+
+	manager := &cloudstackManager{
+		client: cli,
+		shapeTemplates: map[string]vmProfile{
+			"ng1": NodeGroupShapeTemplate{
+				ServiceOfferingID: "offering1",
+				TemplateID:        "template1",
+				ZoneID:            "zone1",
+				MinSize:           1,
+				MaxSize:           5,
+			}.vmProfile("ng1"),
+		},
+	}
+	ng := csNodeGroup{manager: manager, vmProfile: vmProfile{aspMetadata: map[string]string{autoScaleProfileMetadataName: "ng1"}}}
+
+	created, err := ng.Create()
+	require.NoError(t, err)
+	cli.AssertExpectations(t)
+
+	createdNg := created.(*csNodeGroup)
+	assert.Equal(t, "asp1", createdNg.vmProfile.asp.Id)
+	assert.True(t, createdNg.Autoprovisioned())
+}
+
+func Test_csNodeGroup_Create_noShapeTemplate(t *testing.T) {
+	ng := csNodeGroup{
+		manager:   &cloudstackManager{},
+		vmProfile: vmProfile{aspMetadata: map[string]string{autoScaleProfileMetadataName: "ng1"}},
+	}
+
+	_, err := ng.Create()
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrNoShapeTemplate))
+}
+
+func Test_csNodeGroup_Delete(t *testing.T) {
+	cli := &fakeClient{}
+	var params cloudstack.DeleteAutoScaleVmProfileParams
+	params.SetId("asp1")
+	cli.On("DeleteAutoScaleVmProfile", &params).Return(&cloudstack.DeleteAutoScaleVmProfileResponse{}, nil)
+
+	profile := baseVMProfile()
+	profile.asp.Id = "asp1"
+	profile.aspMetadata[autoScaleProfileMetadataAutoprovisioned] = "true"
+	ng := csNodeGroup{manager: &cloudstackManager{client: cli}, vmProfile: profile}
+
+	require.NoError(t, ng.Delete())
+	cli.AssertExpectations(t)
+}
+
+func Test_csNodeGroup_Delete_notAutoprovisioned(t *testing.T) {
+	ng := csNodeGroup{manager: &cloudstackManager{}, vmProfile: baseVMProfile()}
+
+	err := ng.Delete()
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrNodeGroupNotAutoprovisioned))
+}
+
+func Test_csNodeGroup_Delete_hasVMs(t *testing.T) {
+	profile := baseVMProfile()
+	profile.aspMetadata[autoScaleProfileMetadataAutoprovisioned] = "true"
+	ng := csNodeGroup{
+		manager:   &cloudstackManager{},
+		vmProfile: profile,
+		vms:       []*cloudstack.VirtualMachine{{Id: "vm1"}},
+	}
+
+	err := ng.Delete()
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrNodeGroupHasVMs))
+}
+
+func Test_csNodeGroup_TargetSize_countsPending(t *testing.T) {
+	profile := baseVMProfile()
+	profile.aspMetadata[autoScaleProfileMetadataMin] = "1"
+	profile.aspMetadata[autoScaleProfileMetadataMax] = "5"
+	ng := csNodeGroup{
+		manager:   &cloudstackManager{},
+		vmProfile: profile,
+		vms:       []*cloudstack.VirtualMachine{{Id: "vm1"}},
+		pending:   []*pendingVM{{}, {}},
+	}
+
+	size, err := ng.TargetSize()
+	require.NoError(t, err)
+	assert.Equal(t, 3, size)
+}
+
+func Test_csNodeGroup_DecreaseTargetSize_rejectsPositiveDelta(t *testing.T) {
+	ng := csNodeGroup{manager: &cloudstackManager{}, vmProfile: baseVMProfile()}
+	require.Error(t, ng.DecreaseTargetSize(1))
+}
+
+func Test_csNodeGroup_DecreaseTargetSize_cancelsMostRecentPending(t *testing.T) {
+	cli := &fakeClient{}
+	profile := baseVMProfile()
+	profile.aspMetadata[autoScaleProfileMetadataMin] = "0"
+	profile.aspMetadata[autoScaleProfileMetadataMax] = "5"
+	ng := csNodeGroup{
+		manager:   &cloudstackManager{client: cli},
+		vmProfile: profile,
+		pending:   []*pendingVM{{}, {}, {}},
+	}
+
+	require.NoError(t, ng.DecreaseTargetSize(-2))
+
+	assert.Len(t, ng.pending, 1, "only the one oldest pending deployment should remain")
+	cli.AssertExpectations(t)
+}
+
+func Test_csNodeGroup_DecreaseTargetSize_decreasingMoreThanPendingOnlyCancelsPending(t *testing.T) {
+	cli := &fakeClient{}
+	profile := baseVMProfile()
+	profile.aspMetadata[autoScaleProfileMetadataMin] = "0"
+	profile.aspMetadata[autoScaleProfileMetadataMax] = "5"
+	ng := csNodeGroup{
+		manager:   &cloudstackManager{client: cli},
+		vmProfile: profile,
+		vms:       []*cloudstack.VirtualMachine{{Id: "vm1"}, {Id: "vm2"}},
+		pending:   []*pendingVM{{}},
+	}
+
+	require.NoError(t, ng.DecreaseTargetSize(-10))
+
+	assert.Empty(t, ng.pending)
+	assert.Len(t, ng.vms, 2, "DecreaseTargetSize must never delete an existing node")
+}
+
+func Test_csNodeGroup_DecreaseTargetSize_racingJobCompletion(t *testing.T) {
+	cli := &fakeClient{}
+	var destroyParams cloudstack.DestroyVirtualMachineParams
+	destroyParams.SetId("vm-raced")
+	destroyParams.SetExpunge(false)
+	cli.On("DestroyVirtualMachine", &destroyParams).Return(&cloudstack.DestroyVirtualMachineResponse{}, nil)
+
+	profile := baseVMProfile()
+	profile.aspMetadata[autoScaleProfileMetadataMin] = "0"
+	profile.aspMetadata[autoScaleProfileMetadataMax] = "5"
+
+	raced := &pendingVM{}
+	// Simulate the deploy goroutine winning the race against cancel: by the
+	// time DecreaseTargetSize calls cancel, setJob has already recorded the
+	// VM/job id createVM got back from CloudStack.
+	raced.setJob("vm-raced", "job-raced")
+
+	ng := csNodeGroup{
+		manager:   &cloudstackManager{client: cli, scaler: scalerForCancelTest(cli)},
+		vmProfile: profile,
+		vms:       []*cloudstack.VirtualMachine{{Id: "vm1"}, {Id: "vm2"}},
+		pending:   []*pendingVM{raced},
+	}
+
+	require.NoError(t, ng.DecreaseTargetSize(-1))
+
+	assert.Empty(t, ng.pending)
+	cli.AssertExpectations(t)
+}
+
+func Test_csNodeGroup_DecreaseTargetSize_neverDropsBelowMinSize(t *testing.T) {
+	cli := &fakeClient{}
+	profile := baseVMProfile()
+	profile.aspMetadata[autoScaleProfileMetadataMin] = "2"
+	profile.aspMetadata[autoScaleProfileMetadataMax] = "5"
+
+	raced := &pendingVM{}
+	raced.setJob("vm-raced", "job-raced")
+
+	ng := csNodeGroup{
+		manager:   &cloudstackManager{client: cli, scaler: scalerForCancelTest(cli)},
+		vmProfile: profile,
+		vms:       []*cloudstack.VirtualMachine{{Id: "vm1"}, {Id: "vm2"}},
+		pending:   []*pendingVM{raced},
+	}
+
+	require.NoError(t, ng.DecreaseTargetSize(-1))
+
+	// At MinSize already, so the raced VM must be kept rather than
+	// destroyed: DestroyVirtualMachine is never called.
+	cli.AssertNotCalled(t, "DestroyVirtualMachine", mock.Anything)
+}
+
+// scalerForCancelTest builds a csScaler backed by cli, whose Terminating/
+// Terminated Events go to a fake in-memory clientset, for tests that
+// exercise DecreaseTargetSize's destroyVM rollback path.
+func scalerForCancelTest(cli scalerCloudstackClient) *csScaler {
+	return &csScaler{
+		client: cli,
+		events: &kubeEventRecorder{getKubeClient: func() (kubernetes.Interface, error) { return fake.NewSimpleClientset(), nil }},
+	}
+}
+
+func Test_csNodeGroup_DeleteNodes_managedExternally(t *testing.T) {
+	profile := baseVMProfile()
+	profile.aspMetadata[autoScaleProfileMetadataManagedExternallyBy] = managedExternallyByCAPI
+	ng := csNodeGroup{manager: &cloudstackManager{}, vmProfile: profile}
+
+	err := ng.DeleteNodes(nil)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrNodeGroupManagedExternally))
+}
+
+func Test_csNodeGroup_Autoprovisioned(t *testing.T) {
+	ng := csNodeGroup{vmProfile: baseVMProfile()}
+	assert.False(t, ng.Autoprovisioned())
+
+	ng.vmProfile.aspMetadata[autoScaleProfileMetadataAutoprovisioned] = "true"
+	assert.True(t, ng.Autoprovisioned())
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import "sync"
+
+// pendingVM tracks one of manager.scaleUp's in-flight VM deployments for a
+// node group, from the moment scaleUp commits to creating it until either
+// the real VM is picked up by the next refreshNodeGroupVms (manager.scaleUp
+// discards the pendingVM once its own call returns) or DecreaseTargetSize
+// cancels it first. It's what lets TargetSize count reserved-but-not-yet-real
+// capacity and DecreaseTargetSize take back a deployment that hasn't
+// finished yet, both part of the cloudprovider.NodeGroup contract.
+type pendingVM struct {
+	mu sync.Mutex
+
+	// jobID and vmID are set together by setJob, once createVM's
+	// DeployVirtualMachine call has returned. jobID is kept even though
+	// vmID is usually known at the same time, so a cancel racing just
+	// ahead of setJob can still resolve the deployment via
+	// csScaler.queryDeployJob instead of only trusting local state.
+	jobID string
+	vmID  string
+
+	// cancelled is set by cancel. A createVM call that hasn't reported its
+	// vmID yet checks this in setJob once it does, and rolls the VM back
+	// instead of tagging and keeping one DecreaseTargetSize no longer
+	// wants.
+	cancelled bool
+}
+
+// setJob records the CloudStack VM/job id once DeployVirtualMachine has
+// returned, and reports whether this pendingVM was already cancelled by the
+// time it did, so createVM knows whether to roll the VM back.
+func (p *pendingVM) setJob(vmID, jobID string) (cancelled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.vmID, p.jobID = vmID, jobID
+	return p.cancelled
+}
+
+// cancel marks p cancelled and returns the VM/job id recorded so far, if
+// any, so the caller can clean up a deployment that finished (or is
+// finishing) concurrently with this call.
+func (p *pendingVM) cancel() (vmID, jobID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cancelled = true
+	return p.vmID, p.jobID
+}
+
+// addPending registers count new pendingVM placeholders for g and returns
+// them in the order manager.scaleUp should hand them to csScaler.scaleUp -
+// one per VM it's about to attempt. Called before scaleUp starts creating
+// VMs, so TargetSize counts them immediately.
+func (g *csNodeGroup) addPending(count int) []*pendingVM {
+	pending := make([]*pendingVM, count)
+	for i := range pending {
+		pending[i] = &pendingVM{}
+	}
+
+	g.pendingMu.Lock()
+	g.pending = append(g.pending, pending...)
+	g.pendingMu.Unlock()
+	return pending
+}
+
+// removePending removes done from g's pending list once manager.scaleUp has
+// finished with them, successfully or not - the real VM(s), if any, will
+// show up in g.vms on the next refreshNodeGroupVms instead.
+func (g *csNodeGroup) removePending(done []*pendingVM) {
+	g.pendingMu.Lock()
+	defer g.pendingMu.Unlock()
+	for _, p := range done {
+		for i, q := range g.pending {
+			if q == p {
+				g.pending = append(g.pending[:i], g.pending[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// pendingCount returns how many deployments are currently in flight for g.
+func (g *csNodeGroup) pendingCount() int {
+	g.pendingMu.Lock()
+	defer g.pendingMu.Unlock()
+	return len(g.pending)
+}
+
+// cancelPending cancels up to count of g's most recently started pending
+// deployments and returns how many were actually cancelled. The most recent
+// ones are taken first, since they're the ones least likely to have
+// finished yet. See cloudstackManager.cancelPendingVM for how a deployment
+// that raced to completion anyway is handled.
+func (g *csNodeGroup) cancelPending(count int) int {
+	g.pendingMu.Lock()
+	n := len(g.pending)
+	if count > n {
+		count = n
+	}
+	toCancel := g.pending[n-count:]
+	g.pending = g.pending[:n-count]
+	g.pendingMu.Unlock()
+
+	cancelled := 0
+	for _, p := range toCancel {
+		if g.manager.cancelPendingVM(g, p) {
+			cancelled++
+		}
+	}
+	return cancelled
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"fmt"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// csPricingModel prices a node from the hourly price of the ServiceOffering
+// backing it, as cached by cloudstackManager from either an operator-supplied
+// ServiceOfferingPrices override or the "price" ResourceDetail CloudStack
+// reports for the offering.
+type csPricingModel struct {
+	manager *cloudstackManager
+}
+
+func newCsPricingModel(manager *cloudstackManager) *csPricingModel {
+	return &csPricingModel{manager: manager}
+}
+
+// NodePrice returns the approximate cost of running node between startTime
+// and endTime, based on the hourly price of its ServiceOffering.
+func (p *csPricingModel) NodePrice(node *apiv1.Node, startTime time.Time, endTime time.Time) (float64, error) {
+	offeringName, ok := node.Labels[apiv1.LabelInstanceType]
+	if !ok {
+		return 0, fmt.Errorf("node %q has no %s label", node.Name, apiv1.LabelInstanceType)
+	}
+
+	hourlyPrice, ok := p.manager.offeringPrice(offeringName)
+	if !ok {
+		return 0, fmt.Errorf("no known price for service offering %q", offeringName)
+	}
+
+	return hourlyPrice * endTime.Sub(startTime).Hours(), nil
+}
+
+// PodPrice returns the approximate cost of pod. CloudStack bills per VM, not
+// per pod, so pods are priced at 0; their cost is already reflected in the
+// NodePrice of the node they run on.
+func (p *csPricingModel) PodPrice(pod *apiv1.Pod, startTime time.Time, endTime time.Time) (float64, error) {
+	return 0, nil
+}
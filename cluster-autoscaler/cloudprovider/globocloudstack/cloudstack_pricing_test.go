@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_csPricingModel_NodePrice(t *testing.T) {
+	manager := &cloudstackManager{
+		offeringPrices: map[string]float64{
+			"offering1name": 0.5,
+		},
+	}
+	pricing := newCsPricingModel(manager)
+
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node1",
+			Labels: map[string]string{apiv1.LabelInstanceType: "offering1name"},
+		},
+	}
+
+	start := time.Unix(0, 0)
+	price, err := pricing.NodePrice(node, start, start.Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, price)
+}
+
+func Test_csPricingModel_NodePrice_unknownOffering(t *testing.T) {
+	manager := &cloudstackManager{}
+	pricing := newCsPricingModel(manager)
+
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node1",
+			Labels: map[string]string{apiv1.LabelInstanceType: "offering1name"},
+		},
+	}
+
+	start := time.Unix(0, 0)
+	_, err := pricing.NodePrice(node, start, start.Add(time.Hour))
+	assert.Error(t, err)
+}
+
+func Test_csPricingModel_NodePrice_noInstanceTypeLabel(t *testing.T) {
+	manager := &cloudstackManager{}
+	pricing := newCsPricingModel(manager)
+
+	node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+
+	start := time.Unix(0, 0)
+	_, err := pricing.NodePrice(node, start, start.Add(time.Hour))
+	assert.Error(t, err)
+}
+
+func Test_csPricingModel_PodPrice(t *testing.T) {
+	pricing := newCsPricingModel(&cloudstackManager{})
+
+	start := time.Unix(0, 0)
+	price, err := pricing.PodPrice(&apiv1.Pod{}, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, price)
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultProjectRefreshConcurrency = 8
+
+	// defaultStaleCeilingMultiplier sets staleCeiling to this many times
+	// maxAge when a projectCache isn't given an explicit one.
+	defaultStaleCeilingMultiplier = 6
+)
+
+var (
+	projectRefreshDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cloudstack_project_refresh_duration_seconds",
+		Help:    "Duration of projectCache.refresh calls, including collapsed concurrent callers.",
+		Buckets: prometheus.DefBuckets,
+	})
+	projectRefreshErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cloudstack_project_refresh_errors_total",
+		Help: "Number of projectCache.refresh calls that failed to list projects.",
+	})
+	projectCacheAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cloudstack_project_cache_age_seconds",
+		Help: "Age of the project list currently served by projectCache.forEach.",
+	})
+)
+
+// projectCache is the structure responsible for keeping an in-memory cache of
+// existing projects and lazily updating the cache on some interval. It exists
+// because a listProjects call to cloudstack is potentially really slow (think
+// minutes) and doing it on every refresh would not be feasible.
+//
+// The cache is stale-while-revalidate: the first refresh blocks so there's
+// always something to serve, but once primed, an expiry only kicks off a
+// background ListProjects call, while forEach keeps serving the last known
+// list. staleCeiling is the hard limit on how stale that served list is
+// allowed to get before forEach gives up and returns an error instead,
+// because serving arbitrarily stale project data risks silently missing
+// whole projects' worth of node groups.
+//
+// projects/lastUpdated are guarded by mu since asyncRefresh's background
+// doRefresh may write them while forEach is reading them. sf
+// collapses concurrent/overlapping refresh calls down to a single
+// in-flight ListProjects RPC.
+type projectCache struct {
+	mu           sync.RWMutex
+	projects     []*cloudstack.Project
+	client       projectCloudstackClient
+	maxAge       time.Duration
+	staleCeiling time.Duration
+	lastUpdated  time.Time
+	useProjects  bool
+	concurrency  int
+	sf           singleflight.Group
+}
+
+type projectCloudstackClient interface {
+	ListProjects(*cloudstack.ListProjectsParams) (*cloudstack.ListProjectsResponse, error)
+}
+
+func newProjectCache(client projectCloudstackClient, useProjects bool, maxAge, staleCeiling time.Duration, concurrency int) (*projectCache, error) {
+	if maxAge <= 0 {
+		return nil, errors.New("max projects age cannot be <= 0")
+	}
+	if staleCeiling <= 0 {
+		staleCeiling = maxAge * defaultStaleCeilingMultiplier
+	}
+	if concurrency <= 0 {
+		concurrency = defaultProjectRefreshConcurrency
+	}
+	pc := projectCache{
+		client:       client,
+		maxAge:       maxAge,
+		staleCeiling: staleCeiling,
+		useProjects:  useProjects,
+		concurrency:  concurrency,
+	}
+	return &pc, nil
+}
+
+// Prime runs the cache's first, synchronous refresh so the caller (normally
+// newManager, right after construction) pays the cold-cache ListProjects
+// tax once upfront, instead of the first real Refresh()/forEach() call
+// blocking on it.
+func (pc *projectCache) Prime(ctx context.Context) error {
+	return pc.refresh(ctx)
+}
+
+// refresh brings the cache up to date, or schedules a background update: if
+// this is the very first call (the cache has never been populated), it
+// fetches synchronously so there's always something for forEach to serve.
+// Otherwise, an expired cache kicks off an async, singleflight-collapsed
+// refresh and forEach keeps serving the last known list, unless that list
+// is now older than staleCeiling, in which case it returns an error rather
+// than serving unbounded stale data.
+func (pc *projectCache) refresh(ctx context.Context) error {
+	if !pc.useProjects {
+		return nil
+	}
+
+	pc.mu.RLock()
+	lastUpdated := pc.lastUpdated
+	pc.mu.RUnlock()
+
+	if lastUpdated.IsZero() {
+		return pc.syncRefresh(ctx)
+	}
+
+	age := time.Since(lastUpdated)
+	if age > pc.maxAge {
+		pc.asyncRefresh()
+	}
+	if age > pc.staleCeiling {
+		return fmt.Errorf("project list is %s old, older than the %s stale ceiling", age, pc.staleCeiling)
+	}
+	return nil
+}
+
+func (pc *projectCache) syncRefresh(ctx context.Context) error {
+	start := time.Now()
+	_, err, _ := pc.sf.Do("refresh", func() (interface{}, error) {
+		return nil, pc.doRefresh(ctx)
+	})
+	projectRefreshDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		projectRefreshErrors.Inc()
+	}
+	return err
+}
+
+// asyncRefresh kicks off a background doRefresh without blocking the
+// caller. It uses context.Background(), not the caller's ctx, since the
+// refresh should outlive whichever request happened to trigger it and is
+// shared by every caller racing into an expired cache. Overlapping calls
+// collapse onto the same in-flight call via sf.
+func (pc *projectCache) asyncRefresh() {
+	start := time.Now()
+	pc.sf.DoChan("refresh", func() (interface{}, error) {
+		err := pc.doRefresh(context.Background())
+		projectRefreshDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			projectRefreshErrors.Inc()
+		}
+		return nil, err
+	})
+}
+
+// doRefresh issues the actual ListProjects call. It re-checks staleness
+// under a read lock first, because several goroutines may have raced into
+// refresh before singleflight collapsed them onto this single call - then
+// releases it before the (potentially minutes-long) ListProjects call, the
+// same pattern ReplaceDrifted and consolidate use around their own slow
+// CloudStack calls, so forEach's RLock never blocks for the duration of a
+// refresh. The write lock is only re-acquired to install the result.
+func (pc *projectCache) doRefresh(ctx context.Context) error {
+	pc.mu.RLock()
+	stale := time.Since(pc.lastUpdated) > pc.maxAge
+	pc.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+
+	var params cloudstack.ListProjectsParams
+	projects, err := pc.client.ListProjects(&params)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	pc.mu.Lock()
+	pc.lastUpdated = time.Now()
+	pc.projects = projects.Projects
+	pc.mu.Unlock()
+	return nil
+}
+
+// forEach calls fn once per known project (plus once with an empty
+// projectID, to also cover resources outside any project), running up to
+// concurrency calls in parallel. It returns the first error from fn, and
+// cancels the remaining in-flight calls' context.
+func (pc *projectCache) forEach(ctx context.Context, fn func(projectID string) error) error {
+	if err := pc.refresh(ctx); err != nil {
+		return err
+	}
+
+	pc.mu.RLock()
+	projects := append([]*cloudstack.Project{{}}, pc.projects...)
+	lastUpdated := pc.lastUpdated
+	pc.mu.RUnlock()
+
+	if !lastUpdated.IsZero() {
+		projectCacheAge.Set(time.Since(lastUpdated).Seconds())
+	}
+
+	concurrency := pc.concurrency
+	if concurrency <= 0 {
+		concurrency = defaultProjectRefreshConcurrency
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for _, project := range projects {
+		project := project
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fn(project.Id)
+		})
+	}
+	return g.Wait()
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+)
+
+func Test_newProjectCache(t *testing.T) {
+	tests := []struct {
+		useProjects          bool
+		maxAge               time.Duration
+		staleCeiling         time.Duration
+		concurrency          int
+		expectedStaleCeiling time.Duration
+		expectedConcurrency  int
+		expectedErr          string
+	}{
+		{expectedErr: `max projects age cannot be <= 0`},
+		{maxAge: time.Minute, expectedStaleCeiling: defaultStaleCeilingMultiplier * time.Minute, expectedConcurrency: defaultProjectRefreshConcurrency},
+		{useProjects: true, maxAge: time.Minute, expectedStaleCeiling: defaultStaleCeilingMultiplier * time.Minute, expectedConcurrency: defaultProjectRefreshConcurrency},
+		{useProjects: true, maxAge: time.Minute, concurrency: 3, expectedStaleCeiling: defaultStaleCeilingMultiplier * time.Minute, expectedConcurrency: 3},
+		{useProjects: true, maxAge: time.Minute, staleCeiling: 10 * time.Minute, expectedStaleCeiling: 10 * time.Minute, expectedConcurrency: defaultProjectRefreshConcurrency},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			cli := fakeClient{}
+			pc, err := newProjectCache(&cli, tt.useProjects, tt.maxAge, tt.staleCeiling, tt.concurrency)
+			if tt.expectedErr != "" {
+				require.Error(t, err)
+				assert.Regexp(t, tt.expectedErr, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.maxAge, pc.maxAge)
+			assert.Equal(t, tt.useProjects, pc.useProjects)
+			assert.Equal(t, tt.expectedStaleCeiling, pc.staleCeiling)
+			assert.Equal(t, tt.expectedConcurrency, pc.concurrency)
+		})
+	}
+}
+
+func Test_projectCache_refresh(t *testing.T) {
+	t.Run("no projects", func(t *testing.T) {
+		pc := projectCache{}
+		err := pc.refresh(context.Background())
+		assert.NoError(t, err)
+		assert.Nil(t, pc.projects)
+	})
+
+	t.Run("cancelled context after successful call still errors", func(t *testing.T) {
+		cli := fakeClient{}
+		cli.On("ListProjects", mock.Anything).Return(&cloudstack.ListProjectsResponse{
+			Count:    1,
+			Projects: []*cloudstack.Project{{Id: "pj1"}},
+		}, nil)
+		pc := projectCache{client: &cli, maxAge: time.Hour, useProjects: true}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := pc.refresh(ctx)
+		require.Error(t, err)
+	})
+
+	tests := []struct {
+		mockErr          error
+		expectedProjects []*cloudstack.Project
+	}{
+		{expectedProjects: []*cloudstack.Project{
+			{Id: "pj1"},
+		}},
+		{mockErr: errors.New("list err")},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			cli := fakeClient{}
+			cli.On("ListProjects", mock.Anything).Return(&cloudstack.ListProjectsResponse{
+				Count: 1,
+				Projects: []*cloudstack.Project{
+					{Id: "pj1"},
+				},
+			}, tt.mockErr)
+			pc := projectCache{client: &cli, maxAge: 300 * time.Millisecond, useProjects: true}
+
+			err := pc.refresh(context.Background())
+			if tt.mockErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tt.mockErr, err)
+				cli.AssertNumberOfCalls(t, "ListProjects", 1)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedProjects, pc.projects)
+			assert.False(t, pc.lastUpdated.IsZero())
+			cli.AssertNumberOfCalls(t, "ListProjects", 1)
+
+			lastUpdated := pc.lastUpdated
+
+			err = pc.refresh(context.Background())
+			require.NoError(t, err)
+			cli.AssertNumberOfCalls(t, "ListProjects", 1)
+			assert.Equal(t, lastUpdated, pc.lastUpdated)
+		})
+	}
+}
+
+// Test_projectCache_doRefresh_doesNotBlockReadersDuringListProjects confirms
+// doRefresh releases pc.mu before its (potentially minutes-long)
+// ListProjects call, so a concurrent forEach keeps serving the last known
+// project list instead of blocking on RLock for the whole refresh.
+func Test_projectCache_doRefresh_doesNotBlockReadersDuringListProjects(t *testing.T) {
+	release := make(chan struct{})
+	cli := fakeClient{}
+	cli.On("ListProjects", mock.Anything).Run(func(mock.Arguments) {
+		<-release
+	}).Return(&cloudstack.ListProjectsResponse{
+		Count:    1,
+		Projects: []*cloudstack.Project{{Id: "pj1"}},
+	}, nil)
+
+	pc := projectCache{client: &cli, maxAge: time.Millisecond}
+
+	done := make(chan error, 1)
+	go func() { done <- pc.doRefresh(context.Background()) }()
+
+	// Give doRefresh a moment to enter the (blocked) ListProjects call
+	// before asserting reads aren't held up by it.
+	time.Sleep(20 * time.Millisecond)
+
+	readDone := make(chan struct{})
+	go func() {
+		pc.mu.RLock()
+		pc.mu.RUnlock()
+		close(readDone)
+	}()
+
+	select {
+	case <-readDone:
+	case <-time.After(time.Second):
+		t.Fatal("a reader blocked on pc.mu while ListProjects was still in flight")
+	}
+
+	close(release)
+	require.NoError(t, <-done)
+}
+
+func Test_projectCache_forEach(t *testing.T) {
+	var mu sync.Mutex
+	var projIDs []string
+	eachFn := func(projID string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		projIDs = append(projIDs, projID)
+		return nil
+	}
+
+	t.Run("no projects", func(t *testing.T) {
+		projIDs = nil
+		pc := projectCache{}
+		err := pc.forEach(context.Background(), eachFn)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{""}, projIDs)
+	})
+
+	tests := []struct {
+		eachFn             func(projID string) error
+		mockErr            error
+		expectedProjectIDs []string
+		expectedErr        string
+	}{
+		{expectedProjectIDs: []string{"", "pj1"}, eachFn: eachFn},
+		{mockErr: errors.New("list err"), expectedErr: `list err`},
+		{eachFn: func(string) error { return errors.New("myerr") }, expectedErr: `myerr`},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			projIDs = nil
+			cli := fakeClient{}
+			cli.On("ListProjects", mock.Anything).Return(&cloudstack.ListProjectsResponse{
+				Count: 1,
+				Projects: []*cloudstack.Project{
+					{Id: "pj1"},
+				},
+			}, tt.mockErr)
+			pc := projectCache{client: &cli, maxAge: 300 * time.Millisecond, useProjects: true, concurrency: defaultProjectRefreshConcurrency}
+
+			err := pc.forEach(context.Background(), tt.eachFn)
+
+			if tt.expectedErr != "" {
+				require.Error(t, err)
+				assert.Regexp(t, tt.expectedErr, err.Error())
+				return
+			}
+
+			require.NoError(t, err)
+			mu.Lock()
+			assert.ElementsMatch(t, tt.expectedProjectIDs, projIDs)
+			mu.Unlock()
+			cli.AssertNumberOfCalls(t, "ListProjects", 1)
+		})
+	}
+}
@@ -48,21 +48,23 @@ func (cs *csCloudProvider) Name() string {
 
 // NodeGroups returns all node groups configured for this cloud provider.
 func (cs *csCloudProvider) NodeGroups() []cloudprovider.NodeGroup {
-	var nodeGroups []cloudprovider.NodeGroup
-	for i := range cs.manager.nodeGroups {
-		nodeGroups = append(nodeGroups, &cs.manager.nodeGroups[i])
+	nodeGroups := cs.manager.getNodeGroups()
+	var result []cloudprovider.NodeGroup
+	for i := range nodeGroups {
+		result = append(result, &nodeGroups[i])
 	}
-	return nodeGroups
+	return result
 }
 
 // NodeGroupForNode returns the node group for the given node, nil if the node
 // should not be processed by cluster autoscaler, or non-nil error if such
 // occurred. Must be implemented.
 func (cs *csCloudProvider) NodeGroupForNode(node *apiv1.Node) (cloudprovider.NodeGroup, error) {
-	for i, nodeGroup := range cs.manager.nodeGroups {
+	nodeGroups := cs.manager.getNodeGroups()
+	for i, nodeGroup := range nodeGroups {
 		for _, vm := range nodeGroup.vms {
 			if nodeGroup.providerID(vm.Id) == node.Spec.ProviderID {
-				return &cs.manager.nodeGroups[i], nil
+				return &nodeGroups[i], nil
 			}
 		}
 	}
@@ -72,7 +74,7 @@ func (cs *csCloudProvider) NodeGroupForNode(node *apiv1.Node) (cloudprovider.Nod
 // Pricing returns pricing model for this cloud provider or error if not available.
 // Implementation optional.
 func (cs *csCloudProvider) Pricing() (cloudprovider.PricingModel, errors.AutoscalerError) {
-	return nil, cloudprovider.ErrNotImplemented
+	return newCsPricingModel(cs.manager), nil
 }
 
 // GetAvailableMachineTypes get all machine types that can be requested from the cloud provider.
@@ -106,7 +108,7 @@ func (cs *csCloudProvider) GetAvailableGPUTypes() map[string]struct{} {
 
 // Cleanup cleans up open resources before the cloud provider is destroyed, i.e. go routines etc.
 func (cs *csCloudProvider) Cleanup() error {
-	return nil
+	return cs.manager.Cleanup()
 }
 
 // Refresh is called before every main loop and can be used to dynamically update cloud provider state.
@@ -17,100 +17,580 @@ limitations under the License.
 package globocloudstack
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	klog "k8s.io/klog/v2"
 )
 
+// eventNamespace is where ScaleUpComplete timeout Events are recorded.
+// Events about a Node must live somewhere, but Nodes aren't namespaced
+// themselves, so - like kubelet does for its own node-scoped events - they
+// go in the default namespace.
+const eventNamespace = "default"
+
+// ErrVMDeployFailed and ErrVMTaggingFailed wrap createVM's two failure
+// modes, so manager.scaleUp can tell a VM that never got created apart from
+// one that was created but failed to tag when setting csNodeGroup's
+// ProvisioningFailed/TaggingFailed condition.
+var (
+	ErrVMDeployFailed  = errors.New("failed to deploy cloudstack VM")
+	ErrVMTaggingFailed = errors.New("failed to tag cloudstack VM")
+)
+
+// ErrVMDeployCancelled is returned by createVM when the pendingVM tracking
+// its deployment was cancelled by DecreaseTargetSize before tagging
+// completed. csScaler.scaleUp filters it out of its aggregated error, since
+// a cancellation isn't a provisioning failure.
+var ErrVMDeployCancelled = errors.New("vm deployment cancelled")
+
 type csScaler struct {
 	client  scalerCloudstackClient
 	expunge bool
+
+	// requiredDaemonsets and scaleUpTimeout configure ScaleUpComplete's
+	// Helm-style readiness gate: a VM only counts as "up" once its Node is
+	// Ready and every one of these DaemonSets has a Ready pod on it.
+	requiredDaemonsets []string
+	scaleUpTimeout     time.Duration
+
+	// scaleUpOpts configures scaleUp's concurrency, per-VM timeout, retry
+	// and rate-limiting behavior. See ScaleUpOptions.
+	scaleUpOpts ScaleUpOptions
+
+	// events records VM lifecycle Events (Launching, Launched, ...). See
+	// EventRecorder.
+	events EventRecorder
+
+	// kubeClient is built lazily (only once ScaleUpComplete is actually
+	// called) so constructing a csScaler doesn't fail outside a real
+	// cluster, e.g. in unit tests.
+	kubeClientOnce sync.Once
+	kubeClient     kubernetes.Interface
+	kubeClientErr  error
+
+	// userdataCache memoizes resolveUserdataSource's configmap://, secret://
+	// and http(s):// fetches by raw source, so deploying many VMs from the
+	// same node group at once doesn't refetch the same source per VM. See
+	// renderUserdata.
+	userdataCacheMu sync.Mutex
+	userdataCache   map[string]string
 }
 
 type scalerCloudstackClient interface {
 	DestroyVirtualMachine(*cloudstack.DestroyVirtualMachineParams) (*cloudstack.DestroyVirtualMachineResponse, error)
 	DeployVirtualMachine(*cloudstack.DeployVirtualMachineParams) (*cloudstack.DeployVirtualMachineResponse, error)
 	CreateTags(*cloudstack.CreateTagsParams) (*cloudstack.CreateTagsResponse, error)
+	QueryAsyncJobResult(*cloudstack.QueryAsyncJobResultParams) (*cloudstack.QueryAsyncJobResultResponse, error)
 }
 
-func newCsScaler(client scalerCloudstackClient, expunge bool) (*csScaler, error) {
+func newCsScaler(client scalerCloudstackClient, expunge bool, requiredDaemonsets []string, scaleUpTimeout time.Duration, scaleUpOpts ScaleUpOptions) (*csScaler, error) {
 	rand.Seed(time.Now().UnixNano())
-	return &csScaler{
-		client:  client,
-		expunge: expunge,
-	}, nil
+	s := &csScaler{
+		client:             client,
+		expunge:            expunge,
+		requiredDaemonsets: requiredDaemonsets,
+		scaleUpTimeout:     scaleUpTimeout,
+		scaleUpOpts:        scaleUpOpts,
+	}
+	s.events = &kubeEventRecorder{getKubeClient: s.getKubeClient}
+	return s, nil
 }
 
-func (s *csScaler) destroyVM(vmID string) error {
+func (s *csScaler) getKubeClient() (kubernetes.Interface, error) {
+	s.kubeClientOnce.Do(func() {
+		if s.kubeClient != nil {
+			return
+		}
+		cfg, err := rest.InClusterConfig()
+		if err != nil {
+			s.kubeClientErr = fmt.Errorf("building in-cluster config for scale-up readiness checks: %w", err)
+			return
+		}
+		s.kubeClient, s.kubeClientErr = kubernetes.NewForConfig(cfg)
+	})
+	return s.kubeClient, s.kubeClientErr
+}
+
+// ScaleUpComplete reports whether the VM behind providerID has finished
+// joining the cluster as usable capacity: modeled on how Helm 3 considers a
+// release ready only once every resource it rolled out reports its own
+// ready condition, a VM only counts as "up" once its Node is Ready and every
+// configured RequiredDaemonsets has a Ready pod scheduled on that node.
+func (s *csScaler) ScaleUpComplete(ctx context.Context, providerID string) (bool, error) {
+	kubeClient, err := s.getKubeClient()
+	if err != nil {
+		return false, err
+	}
+
+	node, err := nodeForProviderID(ctx, kubeClient, providerID)
+	if err != nil {
+		return false, err
+	}
+	if node == nil || !isNodeReady(node) {
+		return false, nil
+	}
+
+	for _, daemonset := range s.requiredDaemonsets {
+		ready, err := daemonsetPodReady(ctx, kubeClient, daemonset, node.Name)
+		if err != nil {
+			return false, err
+		}
+		if !ready {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// emitScaleUpTimeoutEvent records a Warning Event for the VM that didn't
+// join in time, so operators can spot stuck joins with `kubectl get events`
+// instead of having to dig through autoscaler logs.
+func (s *csScaler) emitScaleUpTimeoutEvent(nodeGroupID, providerID string) {
+	kubeClient, err := s.getKubeClient()
+	if err != nil {
+		klog.Errorf("failed to emit scale-up timeout event for %q: %v", providerID, err)
+		return
+	}
+
+	now := metav1.Now()
+	event := &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "cloudstack-scale-up-timeout-",
+			Namespace:    eventNamespace,
+		},
+		InvolvedObject: apiv1.ObjectReference{
+			Kind: "Node",
+			Name: providerID,
+		},
+		Reason:         "ScaleUpJoinTimeout",
+		Message:        fmt.Sprintf("node group %q: VM %q did not become a Ready node within %s", nodeGroupID, providerID, s.scaleUpTimeout),
+		Type:           apiv1.EventTypeWarning,
+		Source:         apiv1.EventSource{Component: "cluster-autoscaler-globocloudstack"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := kubeClient.CoreV1().Events(eventNamespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		klog.Errorf("failed to emit scale-up timeout event for %q: %v", providerID, err)
+	}
+}
+
+func nodeForProviderID(ctx context.Context, kubeClient kubernetes.Interface, providerID string) (*apiv1.Node, error) {
+	nodes, err := kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range nodes.Items {
+		if nodes.Items[i].Spec.ProviderID == providerID {
+			return &nodes.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func isNodeReady(node *apiv1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == apiv1.NodeReady {
+			return cond.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func daemonsetPodReady(ctx context.Context, kubeClient kubernetes.Interface, daemonset string, nodeName string) (bool, error) {
+	namespace, name, err := splitNamespacedName(daemonset)
+	if err != nil {
+		return false, err
+	}
+
+	ds, err := kubeClient.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(ds.Spec.Selector)
+	if err != nil {
+		return false, err
+	}
+
+	pods, err := kubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", nodeName),
+	})
+	if err != nil {
+		return false, err
+	}
+	for i := range pods.Items {
+		if isPodReady(&pods.Items[i]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isPodReady(pod *apiv1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == apiv1.PodReady {
+			return cond.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func splitNamespacedName(s string) (namespace, name string, err error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("required_daemonsets entry %q must be namespace/name", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+func (s *csScaler) destroyVM(nodeGroupID, vmID string) error {
+	s.events.Terminating(nodeGroupID, vmID)
+	start := time.Now()
+
 	var params cloudstack.DestroyVirtualMachineParams
 	params.SetId(vmID)
 	params.SetExpunge(s.expunge)
 	_, err := s.client.DestroyVirtualMachine(&params)
+	vmDestroyDuration.Observe(time.Since(start).Seconds())
+
 	if isCSErrorNotFound(err, vmID) {
 		klog.V(3).Infof("Tried to destroy cloudstack VM %v but it wasn't found, error ignored", vmID)
+		s.events.Terminated(nodeGroupID, vmID)
 		return nil
 	}
-	return err
+	if err != nil {
+		s.events.TerminationFailed(nodeGroupID, vmID, err)
+		return err
+	}
+	s.events.Terminated(nodeGroupID, vmID)
+	return nil
 }
 
-func (s *csScaler) createVM(deploy cloudstack.DeployVirtualMachineParams, tags cloudstack.CreateTagsParams) (err error) {
+// createVM deploys and tags a single VM. If pending is non-nil, the
+// deployed VM's id and async job id are recorded on it (see
+// pendingVM.setJob) as soon as DeployVirtualMachine returns, before
+// tagging - so a DecreaseTargetSize that cancelled pending concurrently is
+// observed here and rolled back exactly like a tagging failure, instead of
+// being tagged and kept.
+func (s *csScaler) createVM(nodeGroupID string, deploy cloudstack.DeployVirtualMachineParams, tags cloudstack.CreateTagsParams, pending *pendingVM) (id string, err error) {
+	s.events.Launching(nodeGroupID)
+	start := time.Now()
+	defer func() {
+		vmCreateDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	vm, err := s.client.DeployVirtualMachine(&deploy)
 	if err != nil {
+		vmCreateErrors.WithLabelValues("deploy").Inc()
+		s.events.LaunchFailed(nodeGroupID, err)
+		err = fmt.Errorf("%w: %v", ErrVMDeployFailed, err)
 		if vm != nil && vm.Id != "" {
-			destroyErr := s.destroyVM(vm.Id)
+			destroyErr := s.destroyVM(nodeGroupID, vm.Id)
 			if destroyErr != nil {
-				err = fmt.Errorf("unable to destroy cloudstack VM after error creating: %v - original error: %v", destroyErr, err)
+				err = fmt.Errorf("unable to destroy cloudstack VM after error creating: %v - original error: %w", destroyErr, err)
 			}
 		}
-		return err
+		return "", err
 	}
 	defer func() {
 		if err == nil {
 			return
 		}
-		destroyErr := s.destroyVM(vm.Id)
+		destroyErr := s.destroyVM(nodeGroupID, vm.Id)
 		if destroyErr != nil {
-			err = fmt.Errorf("unable to destroy cloudstack VM after tagging error: %v - original error: %v", destroyErr, err)
+			err = fmt.Errorf("unable to destroy cloudstack VM after tagging error: %v - original error: %w", destroyErr, err)
 		}
 	}()
+
+	if pending != nil && pending.setJob(vm.Id, vm.JobID) {
+		err = fmt.Errorf("%w: node group %q", ErrVMDeployCancelled, nodeGroupID)
+		return "", err
+	}
+
 	tags.SetResourceids([]string{vm.Id})
 	tags.SetResourcetype(resourceTypeVirtualMachine)
-	_, err = s.client.CreateTags(&tags)
-	return err
+	if _, err = s.client.CreateTags(&tags); err != nil {
+		vmCreateErrors.WithLabelValues("tag").Inc()
+		s.events.LaunchFailed(nodeGroupID, err)
+		err = fmt.Errorf("%w: %v", ErrVMTaggingFailed, err)
+		return "", err
+	}
+	s.events.Launched(nodeGroupID, vm.Id)
+	return vm.Id, nil
+}
+
+// RetryPolicy configures scaleUp's retry behavior for a single VM's
+// create-and-tag attempt. Transient CloudStack errors (HTTP 429, 5xx, and
+// the well-known transient CloudStack error codes checked by
+// isCSErrorTransient) are retried up to MaxAttempts times with exponential
+// backoff (BaseDelay, doubled each attempt, capped at MaxDelay, plus
+// jitter). Terminal errors - e.g. isCSErrorNotFound - are never retried.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// ScaleUpOptions configures csScaler.scaleUp's concurrency, per-VM timeout,
+// retry and rate-limiting behavior, so a large IncreaseSize can't overwhelm
+// CloudStack's API or exhaust its quotas.
+type ScaleUpOptions struct {
+	// MaxConcurrency bounds how many VMs scaleUp creates at once.
+	MaxConcurrency int
+	// PerCallTimeout bounds a single VM's create-and-tag attempt, including
+	// every retry.
+	PerCallTimeout time.Duration
+	// Retry configures backoff on transient CloudStack errors.
+	Retry RetryPolicy
+	// RateLimiter, if set, is waited on once before every create-and-tag
+	// attempt (one DeployVirtualMachine call and its CreateTags call) that
+	// scaleUp makes, across every concurrent VM.
+	RateLimiter *rate.Limiter
 }
 
-func (s *csScaler) scaleUp(vmp vmProfile, count int) error {
-	errCh := make(chan error, count)
-	wg := sync.WaitGroup{}
+// scaleUp creates count VMs for vmp, up to opts.MaxConcurrency at once, and
+// returns the CloudStack ids of the ones successfully created and tagged,
+// so the caller can track them through ScaleUpComplete. A partial failure
+// still returns the ids that did succeed alongside the error; each failed
+// attempt cleans up its own partially created VM (see createVM) before
+// scaleUp gives up on it, so a partial failure never leaks an
+// untracked, untagged VM.
+//
+// pending, if non-nil, must have exactly count entries: pending[i] tracks
+// the i-th VM's deployment (see pendingVM), letting a concurrent
+// DecreaseTargetSize cancel it before or shortly after it completes. A VM
+// whose createVM call observes its own cancellation returns
+// ErrVMDeployCancelled, which is filtered out of both ids and the
+// aggregated error below - it was deliberately taken back, not a failure.
+func (s *csScaler) scaleUp(ctx context.Context, vmp vmProfile, count int, pending []*pendingVM) ([]string, error) {
+	type result struct {
+		id  string
+		err error
+	}
+
+	opts := s.scaleUpOpts
+	results := make([]result, count)
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.MaxConcurrency)
+
+	zoneIDs := vmp.deployZoneIDs()
 	for i := 0; i < count; i++ {
+		i := i
 		tagsParams := createVMTagsParams(vmp)
 		deployParams := createDeployVMParams(vmp)
-		deployParams.SetName(s.randomName(vmp.Id()))
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			errCh <- s.createVM(deployParams, tagsParams)
-		}()
-	}
-	wg.Wait()
-	close(errCh)
+		nodeName := s.randomName(vmp.Id())
+		deployParams.SetName(nodeName)
+		if userdata, isSet, err := s.renderUserdata(vmp, nodeName); err != nil {
+			results[i].err = fmt.Errorf("rendering userdata: %w", err)
+			continue
+		} else if isSet {
+			deployParams.SetUserdata(userdata)
+		}
+		var p *pendingVM
+		if pending != nil {
+			p = pending[i]
+		}
+		g.Go(func() error {
+			results[i].id, results[i].err = s.createVMAcrossZones(gCtx, vmp.Id(), zoneIDs, deployParams, tagsParams, opts, p)
+			return nil
+		})
+	}
+	// The errgroup's own error is ignored: every createVMWithRetry failure
+	// is recorded in results instead of aborting the remaining VMs, so one
+	// slow or failing VM doesn't stop count-1 other, perfectly fine VMs
+	// from being created.
+	_ = g.Wait()
+
+	var ids []string
 	var errorMsgs []string
-	for err := range errCh {
-		if err != nil {
-			errorMsgs = append(errorMsgs, err.Error())
+	var firstErr error
+	for _, r := range results {
+		if r.err != nil {
+			if errors.Is(r.err, ErrVMDeployCancelled) {
+				continue
+			}
+			errorMsgs = append(errorMsgs, r.err.Error())
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
 		}
+		ids = append(ids, r.id)
 	}
 	if len(errorMsgs) > 0 {
-		return fmt.Errorf("error creating VMs: %v", strings.Join(errorMsgs, " - "))
+		// Wrapping firstErr (rather than just joining every message as text)
+		// lets manager.scaleUp tell ErrVMTaggingFailed apart from
+		// ErrVMDeployFailed with errors.Is when setting csNodeGroup's
+		// ProvisioningFailed/TaggingFailed condition, even though every
+		// individual failure is still listed in the message.
+		return ids, fmt.Errorf("error creating VMs: %w (%s)", firstErr, strings.Join(errorMsgs, " - "))
 	}
-	return nil
+	return ids, nil
+}
+
+// createVMWithRetry retries createVM with exponential backoff and jitter on
+// transient CloudStack errors, honoring opts.PerCallTimeout and
+// opts.RateLimiter, and never retrying a terminal error - including
+// ErrVMDeployCancelled, so a deployment DecreaseTargetSize took back isn't
+// retried right back into existence.
+func (s *csScaler) createVMWithRetry(ctx context.Context, nodeGroupID string, deploy cloudstack.DeployVirtualMachineParams, tags cloudstack.CreateTagsParams, opts ScaleUpOptions, pending *pendingVM) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.PerCallTimeout)
+	defer cancel()
+
+	maxAttempts := opts.Retry.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := waitBackoff(ctx, opts.Retry, attempt); err != nil {
+				return "", lastErr
+			}
+		}
+		if opts.RateLimiter != nil {
+			if err := opts.RateLimiter.Wait(ctx); err != nil {
+				return "", err
+			}
+		}
+
+		id, err := s.createVM(nodeGroupID, deploy, tags, pending)
+		if err == nil {
+			return id, nil
+		}
+		lastErr = err
+		if errors.Is(err, ErrVMDeployCancelled) || !isCSErrorTransient(err) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("giving up after %d attempts: %w", maxAttempts, lastErr)
+}
+
+// createVMAcrossZones attempts to deploy and tag a VM in each of zoneIDs in
+// turn, falling back to the next zone only when an attempt - including its
+// own createVMWithRetry transient-error retries - exhausts itself with what
+// looks like that zone being out of capacity (see
+// isCSErrorInsufficientCapacity). Any other failure, or running out of
+// zones, is returned as-is. zoneIDs is ordered priority, not a load-balanced
+// set: the first zone is always tried first. A single-zone profile (the
+// common case, see vmProfile.deployZoneIDs) degenerates to one iteration,
+// identical to calling createVMWithRetry directly.
+func (s *csScaler) createVMAcrossZones(ctx context.Context, nodeGroupID string, zoneIDs []string, deploy cloudstack.DeployVirtualMachineParams, tags cloudstack.CreateTagsParams, opts ScaleUpOptions, pending *pendingVM) (string, error) {
+	var lastErr error
+	for i, zoneID := range zoneIDs {
+		deploy.SetZoneid(zoneID)
+		id, err := s.createVMWithRetry(ctx, nodeGroupID, deploy, tags, opts, pending)
+		if err == nil {
+			return id, nil
+		}
+		if errors.Is(err, ErrVMDeployCancelled) {
+			return "", err
+		}
+		lastErr = err
+		if i == len(zoneIDs)-1 || !isCSErrorInsufficientCapacity(err) {
+			return "", err
+		}
+		klog.Warningf("node group %q: zone %q out of capacity, trying next zone: %v", nodeGroupID, zoneID, err)
+	}
+	return "", lastErr
+}
+
+// isCSErrorInsufficientCapacity reports whether err looks like CloudStack
+// rejecting a deploy because the target zone itself has no host or storage
+// capacity left for it, as opposed to some other deploy failure. Unlike
+// isCSErrorTransient, this is never retried in the same zone -
+// createVMAcrossZones instead moves on to the next configured zone.
+func isCSErrorInsufficientCapacity(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, pattern := range insufficientCapacityCSErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+var insufficientCapacityCSErrorPatterns = []string{
+	"InsufficientCapacityException",
+	"InsufficientServerCapacityException",
+	"InsufficientAddressCapacityException",
+	fmt.Sprintf("errorcode %d", outOfResourcesJobErrorCode),
+}
+
+// waitBackoff sleeps for attempt's exponential backoff delay (BaseDelay
+// doubled per attempt, capped at MaxDelay, with up to 50% jitter), or
+// returns ctx.Err() if ctx is done first.
+func waitBackoff(ctx context.Context, retry RetryPolicy, attempt int) error {
+	delay := retry.BaseDelay << uint(attempt-1)
+	if retry.MaxDelay > 0 && delay > retry.MaxDelay {
+		delay = retry.MaxDelay
+	}
+	delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isCSErrorTransient reports whether err looks like a transient CloudStack
+// failure worth retrying: an HTTP 429/5xx status, or one of the well-known
+// CloudStack error messages that indicate the same (API throttling, the job
+// queue being full, or an async job timing out before CloudStack itself
+// finished). It deliberately does not match isCSErrorNotFound-style "does
+// not exist" errors, which are terminal.
+func isCSErrorTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, code := range transientCSErrorStatusCodes {
+		if strings.Contains(msg, code) {
+			return true
+		}
+	}
+	for _, pattern := range transientCSErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+var transientCSErrorStatusCodes = []string{"429", "500", "502", "503", "504"}
+
+var transientCSErrorPatterns = []string{
+	"async job failed to complete",
+	"Timed out waiting for async job",
+	"Internal error executing command",
+	"too many jobs in job queue",
 }
 
 func (s *csScaler) randomName(base string) string {
@@ -128,13 +608,20 @@ func createDeployVMParams(vmp vmProfile) cloudstack.DeployVirtualMachineParams {
 		params.SetProjectid(projID)
 	}
 	params.SetServiceofferingid(asp.Serviceofferingid)
-	params.SetZoneid(asp.Zoneid)
+	// Zoneid is deliberately left unset here - csScaler.createVMAcrossZones
+	// sets it per deploy attempt, from vmp.deployZoneIDs(), so a multi-zone
+	// profile can fail over to its next zone without rebuilding params.
 	params.SetTemplateid(asp.Templateid)
 	if values, err := url.ParseQuery(asp.Otherdeployparams); err == nil {
 		setOtherParams(values, &params)
 	}
-	if userdata, isSet := vmp.userdata(); isSet {
-		params.SetUserdata(userdata)
+	// Userdata is deliberately left unset here - csScaler.scaleUp sets it via
+	// renderUserdata instead, once it has generated the VM's name, since a
+	// templated userdata source can reference {{.NodeName}}.
+	// iptonetworklist can't flow through setOtherParams (see
+	// vmProfile.ipToNetworkList), so it's threaded through explicitly.
+	if ipToNetworkList := vmp.ipToNetworkList(); len(ipToNetworkList) > 0 {
+		params.SetIptonetworklist(ipToNetworkList)
 	}
 	return params
 }
@@ -142,66 +629,289 @@ func createDeployVMParams(vmp vmProfile) cloudstack.DeployVirtualMachineParams {
 func createVMTagsParams(vmp vmProfile) cloudstack.CreateTagsParams {
 	tags := vmp.tags()
 	tags[nodeGroupVMTag] = vmp.Id()
+	tags[nodeGroupProfileHashTag] = vmp.driftHash()
+	for _, c := range driftCategories {
+		tags[c.tag] = c.hash(&vmp)
+	}
 	var params cloudstack.CreateTagsParams
 	params.SetTags(tags)
 	return params
 }
 
-func setOtherParams(values url.Values, params *cloudstack.DeployVirtualMachineParams) {
-	if v, found := valueGet(values, "account"); found {
-		params.SetAccount(v)
-	}
-	if v, found := valueGet(values, "affinitygroupids"); found {
-		vv := strings.Split(v, ",")
-		params.SetAffinitygroupids(vv)
+// otherParamSetter describes one *cloudstack.DeployVirtualMachineParams
+// Set* method discovered by reflection: its name (to call it) and its
+// single argument's type (to know how to parse a raw string into it).
+type otherParamSetter struct {
+	method  string
+	argType reflect.Type
+}
+
+// otherParamSetters is built once from *cloudstack.DeployVirtualMachineParams
+// itself, keyed by the lower-cased setter name with its "Set" prefix
+// stripped (e.g. "SetDhcpoptionsnetworklist" -> "dhcpoptionsnetworklist",
+// matching the OtherDeployParams query-string key). This way every setter
+// the vendored go-cloudstack version ships - including ones added after
+// this file was last touched - is usable from OtherDeployParams without
+// another hand-written case.
+var otherParamSetters = buildOtherParamSetters(reflect.TypeOf(&cloudstack.DeployVirtualMachineParams{}))
+
+func buildOtherParamSetters(t reflect.Type) map[string]otherParamSetter {
+	setters := make(map[string]otherParamSetter, t.NumMethod())
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !strings.HasPrefix(m.Name, "Set") || m.Type.NumIn() != 2 {
+			continue
+		}
+		argType := m.Type.In(1)
+		switch argType.Kind() {
+		case reflect.String, reflect.Int64, reflect.Bool:
+		case reflect.Slice:
+			if argType.Elem().Kind() != reflect.String {
+				continue
+			}
+		case reflect.Map:
+			if argType.Key().Kind() != reflect.String || argType.Elem().Kind() != reflect.String {
+				continue
+			}
+		default:
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(m.Name, "Set"))
+		setters[key] = otherParamSetter{method: m.Name, argType: argType}
 	}
-	if v, found := valueGet(values, "affinitygroupnames"); found {
-		vv := strings.Split(v, ",")
-		params.SetAffinitygroupnames(vv)
+	return setters
+}
+
+// parse converts a raw OtherDeployParams value into s's setter argument
+// type: comma-separated for []string, "k1=v1,k2=v2" for map[string]string,
+// otherwise a plain scalar conversion.
+func (s otherParamSetter) parse(raw string) (reflect.Value, error) {
+	switch s.argType.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(raw), nil
+	case reflect.Int64:
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(v), nil
+	case reflect.Bool:
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(v), nil
+	case reflect.Slice:
+		parts := strings.Split(raw, ",")
+		slice := reflect.MakeSlice(s.argType, len(parts), len(parts))
+		for i, part := range parts {
+			slice.Index(i).SetString(part)
+		}
+		return slice, nil
+	case reflect.Map:
+		m := reflect.MakeMapWithSize(s.argType, 0)
+		for _, pair := range strings.Split(raw, ",") {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("expected key=value, got %q", pair)
+			}
+			m.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(v))
+		}
+		return m, nil
+	default:
+		return reflect.Value{}, fmt.Errorf("unsupported setter argument type %s", s.argType)
 	}
-	if v, found := valueGet(values, "diskofferingid"); found {
-		params.SetDiskofferingid(v)
+}
+
+// setOtherParams applies every OtherDeployParams entry that has a matching
+// *cloudstack.DeployVirtualMachineParams Set* method (see otherParamSetters)
+// to params, so new go-cloudstack setters become usable from
+// OtherDeployParams without a code change here.
+func setOtherParams(values url.Values, params *cloudstack.DeployVirtualMachineParams) {
+	paramsVal := reflect.ValueOf(params)
+	for key := range values {
+		setter, ok := otherParamSetters[strings.ToLower(key)]
+		if !ok {
+			klog.V(2).Infof("otherdeployparams key %q has no matching DeployVirtualMachineParams setter, ignored", key)
+			continue
+		}
+		raw, found := valueGet(values, key)
+		if !found {
+			continue
+		}
+		arg, err := setter.parse(raw)
+		if err != nil {
+			klog.Errorf("otherdeployparams key %q: %v", key, err)
+			continue
+		}
+		paramsVal.MethodByName(setter.method).Call([]reflect.Value{arg})
 	}
-	if v, found := valueGet(values, "displayname"); found {
-		params.SetDisplayname(v)
+}
+
+func valueGet(values url.Values, key string) (string, bool) {
+	_, isSet := values[key]
+	return values.Get(key), isSet
+}
+
+// CloudStack async job status codes, from
+// cloudstack.QueryAsyncJobResultResponse.Jobstatus.
+const (
+	jobStatusPending = 0
+	jobStatusSuccess = 1
+	jobStatusFailed  = 2
+)
+
+// jobVMResult is the subset of a DeployVirtualMachine job's Jobresult
+// payload queryDeployJob needs: the id of the VM it created, if it
+// succeeded.
+type jobVMResult struct {
+	VirtualMachine struct {
+		Id string `json:"id"`
+	} `json:"virtualmachine"`
+}
+
+// queryJob fetches jobID's current QueryAsyncJobResult.
+func (s *csScaler) queryJob(jobID string) (*cloudstack.QueryAsyncJobResultResponse, error) {
+	var params cloudstack.QueryAsyncJobResultParams
+	params.SetJobid(jobID)
+	return s.client.QueryAsyncJobResult(&params)
+}
+
+// queryDeployJob reports whether jobID's deploy job has finished and, if it
+// finished successfully, the id of the VM it created. Used by
+// cloudstackManager.cancelPendingVM to resolve a pendingVM that raced ahead
+// of createVM's own local bookkeeping. A still-pending job returns ("",
+// false, nil), same as a jobID that can't be resolved at all.
+func (s *csScaler) queryDeployJob(jobID string) (vmID string, done bool, err error) {
+	if jobID == "" {
+		return "", false, nil
 	}
-	if v, found := valueGet(values, "hypervisor"); found {
-		params.SetHypervisor(v)
+
+	resp, err := s.queryJob(jobID)
+	if err != nil {
+		return "", false, err
 	}
-	if v, found := valueGet(values, "keyboard"); found {
-		params.SetKeyboard(v)
+	if resp.Jobstatus == jobStatusPending {
+		return "", false, nil
 	}
-	if v, found := valueGet(values, "keypair"); found {
-		params.SetKeypair(v)
+	if resp.Jobstatus != jobStatusSuccess || len(resp.Jobresult) == 0 {
+		return "", true, nil
 	}
-	if v, found := valueGet(values, "networkids"); found {
-		vv := strings.Split(v, ",")
-		params.SetNetworkids(vv)
+
+	var result jobVMResult
+	if err := json.Unmarshal(resp.Jobresult, &result); err != nil {
+		return "", true, fmt.Errorf("parsing async job result for job %q: %w", jobID, err)
 	}
-	if v, found := valueGet(values, "rootdisksize"); found {
-		vv, _ := strconv.ParseInt(v, 10, 64)
-		params.SetRootdisksize(vv)
+	return result.VirtualMachine.Id, true, nil
+}
+
+// cachedJobResult returns jobID's current QueryAsyncJobResult, populating
+// cache on the way so a jobID already seen during the same Nodes() call
+// isn't queried twice. A blank jobID (no job in flight for the VM) isn't an
+// error - it's reported as a nil result.
+func (s *csScaler) cachedJobResult(jobID string, cache map[string]*cloudstack.QueryAsyncJobResultResponse) (*cloudstack.QueryAsyncJobResultResponse, error) {
+	if jobID == "" {
+		return nil, nil
 	}
-	if v, found := valueGet(values, "securitygroupids"); found {
-		vv := strings.Split(v, ",")
-		params.SetSecuritygroupids(vv)
+	if resp, ok := cache[jobID]; ok {
+		return resp, nil
 	}
-	if v, found := valueGet(values, "securitygroupnames"); found {
-		vv := strings.Split(v, ",")
-		params.SetSecuritygroupnames(vv)
+	resp, err := s.queryJob(jobID)
+	if err != nil {
+		return nil, err
 	}
-	if v, found := valueGet(values, "size"); found {
-		vv, _ := strconv.ParseInt(v, 10, 64)
-		params.SetSize(vv)
+	cache[jobID] = resp
+	return resp, nil
+}
+
+// jobErrorResult is the subset of a failed async job's Jobresult payload
+// instanceStatus needs to classify the failure.
+type jobErrorResult struct {
+	ErrorCode int    `json:"errorcode"`
+	ErrorText string `json:"errortext"`
+}
+
+// outOfResourcesJobErrorCode is the CloudStack API error code returned when
+// a deploy job fails because no host or storage pool had enough capacity
+// left for the VM.
+const outOfResourcesJobErrorCode = 431
+
+// isOutOfResourcesJobError reports whether a failed job's Jobresult payload
+// is CloudStack reporting it ran out of capacity, rather than some other
+// provisioning failure.
+func isOutOfResourcesJobError(raw json.RawMessage) bool {
+	var result jobErrorResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return false
 	}
-	if v, found := valueGet(values, "userdata"); found {
-		params.SetUserdata(v)
+	return result.ErrorCode == outOfResourcesJobErrorCode
+}
+
+// jobErrorText extracts errortext from a failed job's Jobresult payload,
+// falling back to the raw payload if it doesn't parse as expected.
+func jobErrorText(raw json.RawMessage) string {
+	var result jobErrorResult
+	if err := json.Unmarshal(raw, &result); err == nil && result.ErrorText != "" {
+		return result.ErrorText
 	}
+	return string(raw)
 }
 
-func valueGet(values url.Values, key string) (string, bool) {
-	_, isSet := values[key]
-	return values.Get(key), isSet
+// instanceStatus maps vm's State together with the current state of its
+// most recent async job (vm.Jobid) into the richer cloudprovider.InstanceStatus
+// cluster-autoscaler uses to decide whether to keep waiting on a node or
+// back off. jobCache is populated as VMs are processed, so it should be
+// scoped to a single Nodes() call and discarded afterward - see
+// csNodeGroup.Nodes().
+//
+// Possible vm.State values from
+// https://github.com/apache/cloudstack/blob/87c43501608a1df72a2f01ed17a522233e6617b0/api/src/main/java/com/cloud/vm/VirtualMachine.java#L45
+func (s *csScaler) instanceStatus(vm *cloudstack.VirtualMachine, jobCache map[string]*cloudstack.QueryAsyncJobResultResponse) *cloudprovider.InstanceStatus {
+	job, err := s.cachedJobResult(vm.Jobid, jobCache)
+	if err != nil {
+		klog.Errorf("checking async job %q for vm %q: %v", vm.Jobid, vm.Id, err)
+	}
+
+	switch vm.State {
+	case "Starting", "Migrating":
+		if job != nil && job.Jobstatus == jobStatusFailed {
+			if isOutOfResourcesJobError(job.Jobresult) {
+				return &cloudprovider.InstanceStatus{
+					State: cloudprovider.InstanceCreating,
+					ErrorInfo: &cloudprovider.InstanceErrorInfo{
+						ErrorClass:   cloudprovider.OutOfResourcesErrorClass,
+						ErrorCode:    "InsufficientCapacity",
+						ErrorMessage: fmt.Sprintf("vm %q: %s", vm.Id, jobErrorText(job.Jobresult)),
+					},
+				}
+			}
+			return &cloudprovider.InstanceStatus{
+				State: cloudprovider.InstanceCreating,
+				ErrorInfo: &cloudprovider.InstanceErrorInfo{
+					ErrorClass:   cloudprovider.OtherErrorClass,
+					ErrorMessage: fmt.Sprintf("vm %q: create job failed: %s", vm.Id, jobErrorText(job.Jobresult)),
+				},
+			}
+		}
+		return &cloudprovider.InstanceStatus{State: cloudprovider.InstanceCreating}
+	case "Running":
+		return &cloudprovider.InstanceStatus{State: cloudprovider.InstanceRunning}
+	case "Stopping", "Stopped", "Destroyed", "Expunging", "Shutdowned":
+		if vm.Jobid != "" && (job == nil || job.Jobstatus == jobStatusPending) {
+			// The destroy job hasn't confirmed the VM is actually gone yet;
+			// don't report it as deleting until it has, so CA doesn't write
+			// off a VM that's still there.
+			return &cloudprovider.InstanceStatus{State: cloudprovider.InstanceRunning}
+		}
+		return &cloudprovider.InstanceStatus{State: cloudprovider.InstanceDeleting}
+	default:
+		return &cloudprovider.InstanceStatus{
+			ErrorInfo: &cloudprovider.InstanceErrorInfo{
+				ErrorClass:   cloudprovider.OtherErrorClass,
+				ErrorMessage: fmt.Sprintf("unexpected vm state: %v", vm.State),
+			},
+		}
+	}
 }
 
 func isCSErrorNotFound(err error, id string) bool {
@@ -0,0 +1,461 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_csScaler_ScaleUpComplete_nodeNotFound(t *testing.T) {
+	s := &csScaler{kubeClient: fake.NewSimpleClientset()}
+
+	ready, err := s.ScaleUpComplete(context.Background(), "cloudstack:///vm1")
+	require.NoError(t, err)
+	assert.False(t, ready)
+}
+
+func Test_csScaler_ScaleUpComplete_nodeNotReady(t *testing.T) {
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       apiv1.NodeSpec{ProviderID: "cloudstack:///vm1"},
+		Status: apiv1.NodeStatus{
+			Conditions: []apiv1.NodeCondition{
+				{Type: apiv1.NodeReady, Status: apiv1.ConditionFalse},
+			},
+		},
+	}
+	s := &csScaler{kubeClient: fake.NewSimpleClientset(node)}
+
+	ready, err := s.ScaleUpComplete(context.Background(), "cloudstack:///vm1")
+	require.NoError(t, err)
+	assert.False(t, ready)
+}
+
+func Test_csScaler_ScaleUpComplete_readyNodeNoRequiredDaemonsets(t *testing.T) {
+	node := readyNode("node1", "cloudstack:///vm1")
+	s := &csScaler{kubeClient: fake.NewSimpleClientset(node)}
+
+	ready, err := s.ScaleUpComplete(context.Background(), "cloudstack:///vm1")
+	require.NoError(t, err)
+	assert.True(t, ready)
+}
+
+func Test_csScaler_ScaleUpComplete_waitsForRequiredDaemonsetPod(t *testing.T) {
+	node := readyNode("node1", "cloudstack:///vm1")
+	ds := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "ds1", Namespace: "kube-system"},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "ds1"}},
+		},
+	}
+
+	s := &csScaler{
+		kubeClient:         fake.NewSimpleClientset(node, ds),
+		requiredDaemonsets: []string{"kube-system/ds1"},
+	}
+
+	ready, err := s.ScaleUpComplete(context.Background(), "cloudstack:///vm1")
+	require.NoError(t, err)
+	assert.False(t, ready, "no pod scheduled yet for the required daemonset")
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "ds1-abcde", Namespace: "kube-system", Labels: map[string]string{"app": "ds1"}},
+		Spec:       apiv1.PodSpec{NodeName: "node1"},
+		Status: apiv1.PodStatus{
+			Conditions: []apiv1.PodCondition{
+				{Type: apiv1.PodReady, Status: apiv1.ConditionTrue},
+			},
+		},
+	}
+	s.kubeClient = fake.NewSimpleClientset(node, ds, pod)
+
+	ready, err = s.ScaleUpComplete(context.Background(), "cloudstack:///vm1")
+	require.NoError(t, err)
+	assert.True(t, ready)
+}
+
+func Test_csScaler_emitScaleUpTimeoutEvent(t *testing.T) {
+	cli := fake.NewSimpleClientset()
+	s := &csScaler{kubeClient: cli, scaleUpTimeout: 15 * time.Minute}
+
+	s.emitScaleUpTimeoutEvent("ng1", "cloudstack:///vm1")
+
+	events, err := cli.CoreV1().Events(eventNamespace).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	assert.Equal(t, "ScaleUpJoinTimeout", events.Items[0].Reason)
+}
+
+func readyNode(name, providerID string) *apiv1.Node {
+	return &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       apiv1.NodeSpec{ProviderID: providerID},
+		Status: apiv1.NodeStatus{
+			Conditions: []apiv1.NodeCondition{
+				{Type: apiv1.NodeReady, Status: apiv1.ConditionTrue},
+			},
+		},
+	}
+}
+
+// fakeScaleUpClient is a scalerCloudstackClient whose DeployVirtualMachine
+// behavior is scripted per call via deployFn, so tests can simulate
+// transient failures, terminal failures and retries deterministically.
+type fakeScaleUpClient struct {
+	deployCalls  int32
+	destroyCalls int32
+	deployFn     func(callN int32) (*cloudstack.DeployVirtualMachineResponse, error)
+}
+
+func (f *fakeScaleUpClient) DeployVirtualMachine(*cloudstack.DeployVirtualMachineParams) (*cloudstack.DeployVirtualMachineResponse, error) {
+	n := atomic.AddInt32(&f.deployCalls, 1)
+	return f.deployFn(n)
+}
+
+func (f *fakeScaleUpClient) CreateTags(*cloudstack.CreateTagsParams) (*cloudstack.CreateTagsResponse, error) {
+	return &cloudstack.CreateTagsResponse{}, nil
+}
+
+func (f *fakeScaleUpClient) DestroyVirtualMachine(*cloudstack.DestroyVirtualMachineParams) (*cloudstack.DestroyVirtualMachineResponse, error) {
+	atomic.AddInt32(&f.destroyCalls, 1)
+	return &cloudstack.DestroyVirtualMachineResponse{}, nil
+}
+
+func (f *fakeScaleUpClient) QueryAsyncJobResult(*cloudstack.QueryAsyncJobResultParams) (*cloudstack.QueryAsyncJobResultResponse, error) {
+	return &cloudstack.QueryAsyncJobResultResponse{Jobstatus: jobStatusSuccess}, nil
+}
+
+func scalerForScaleUpTest(client scalerCloudstackClient, opts ScaleUpOptions) *csScaler {
+	if opts.MaxConcurrency <= 0 {
+		opts.MaxConcurrency = 4
+	}
+	if opts.PerCallTimeout <= 0 {
+		opts.PerCallTimeout = time.Second
+	}
+	if opts.Retry.MaxAttempts <= 0 {
+		opts.Retry.MaxAttempts = 1
+	}
+	return &csScaler{
+		client:      client,
+		scaleUpOpts: opts,
+		events:      &kubeEventRecorder{getKubeClient: func() (kubernetes.Interface, error) { return fake.NewSimpleClientset(), nil }},
+	}
+}
+
+func Test_csScaler_scaleUp_partialFailure(t *testing.T) {
+	cli := &fakeScaleUpClient{
+		deployFn: func(callN int32) (*cloudstack.DeployVirtualMachineResponse, error) {
+			if callN%2 == 0 {
+				return nil, fmt.Errorf("quota exceeded for account")
+			}
+			return &cloudstack.DeployVirtualMachineResponse{Id: fmt.Sprintf("vm%d", callN)}, nil
+		},
+	}
+	s := scalerForScaleUpTest(cli, ScaleUpOptions{MaxConcurrency: 4, Retry: RetryPolicy{MaxAttempts: 1}})
+
+	ids, err := s.scaleUp(context.Background(), baseVMProfile(), 4, nil)
+
+	require.Error(t, err)
+	assert.Len(t, ids, 2, "the two successful deploys should still be returned alongside the error")
+}
+
+func Test_csScaler_scaleUp_retriesTransientErrorsThenSucceeds(t *testing.T) {
+	cli := &fakeScaleUpClient{
+		deployFn: func(callN int32) (*cloudstack.DeployVirtualMachineResponse, error) {
+			if callN < 3 {
+				return nil, fmt.Errorf("HTTP 503: Service Unavailable")
+			}
+			return &cloudstack.DeployVirtualMachineResponse{Id: "vm-ok"}, nil
+		},
+	}
+	s := scalerForScaleUpTest(cli, ScaleUpOptions{
+		MaxConcurrency: 1,
+		Retry:          RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+	})
+
+	ids, err := s.scaleUp(context.Background(), baseVMProfile(), 1, nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vm-ok"}, ids)
+}
+
+func Test_csScaler_scaleUp_retryExhaustion(t *testing.T) {
+	cli := &fakeScaleUpClient{
+		deployFn: func(int32) (*cloudstack.DeployVirtualMachineResponse, error) {
+			return nil, fmt.Errorf("HTTP 503: Service Unavailable")
+		},
+	}
+	s := scalerForScaleUpTest(cli, ScaleUpOptions{
+		MaxConcurrency: 1,
+		Retry:          RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+	})
+
+	ids, err := s.scaleUp(context.Background(), baseVMProfile(), 1, nil)
+
+	require.Error(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&cli.deployCalls), "should have retried up to MaxAttempts times")
+}
+
+func Test_csScaler_scaleUp_terminalErrorNotRetried(t *testing.T) {
+	cli := &fakeScaleUpClient{
+		deployFn: func(int32) (*cloudstack.DeployVirtualMachineResponse, error) {
+			return nil, fmt.Errorf("Invalid parameter id value=x due to incorrect long value format, or entity does not exist")
+		},
+	}
+	s := scalerForScaleUpTest(cli, ScaleUpOptions{MaxConcurrency: 1, Retry: RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond}})
+
+	_, err := s.scaleUp(context.Background(), baseVMProfile(), 1, nil)
+
+	require.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cli.deployCalls), "a terminal error should not be retried")
+}
+
+func Test_csScaler_scaleUp_rateLimiterBlocksUntilContextDeadline(t *testing.T) {
+	cli := &fakeScaleUpClient{
+		deployFn: func(callN int32) (*cloudstack.DeployVirtualMachineResponse, error) {
+			return &cloudstack.DeployVirtualMachineResponse{Id: fmt.Sprintf("vm%d", callN)}, nil
+		},
+	}
+	// A rate of practically zero with no burst means the second VM can
+	// never acquire a token before the context below expires.
+	s := scalerForScaleUpTest(cli, ScaleUpOptions{
+		MaxConcurrency: 2,
+		PerCallTimeout: 50 * time.Millisecond,
+		Retry:          RetryPolicy{MaxAttempts: 1},
+		RateLimiter:    rate.NewLimiter(rate.Limit(0.001), 1),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	ids, err := s.scaleUp(ctx, baseVMProfile(), 2, nil)
+
+	require.Error(t, err)
+	assert.Len(t, ids, 1, "only the VM that got the initial burst token should be created")
+}
+
+func Test_csScaler_scaleUp_failsOverToNextZoneOnInsufficientCapacity(t *testing.T) {
+	cli := &fakeScaleUpClient{
+		deployFn: func(callN int32) (*cloudstack.DeployVirtualMachineResponse, error) {
+			if callN == 1 {
+				return nil, fmt.Errorf("InsufficientCapacityException: no suitable host found in zone zoneA")
+			}
+			return &cloudstack.DeployVirtualMachineResponse{Id: "vm-in-zoneB"}, nil
+		},
+	}
+	s := scalerForScaleUpTest(cli, ScaleUpOptions{MaxConcurrency: 1, Retry: RetryPolicy{MaxAttempts: 1}})
+
+	vmp := baseVMProfile()
+	vmp.zoneIDs = []string{"zoneA", "zoneB"}
+
+	ids, err := s.scaleUp(context.Background(), vmp, 1, nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vm-in-zoneB"}, ids)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cli.deployCalls), "should have tried zoneA then fallen back to zoneB")
+}
+
+func Test_csScaler_scaleUp_exhaustsAllZonesOnInsufficientCapacity(t *testing.T) {
+	cli := &fakeScaleUpClient{
+		deployFn: func(int32) (*cloudstack.DeployVirtualMachineResponse, error) {
+			return nil, fmt.Errorf("InsufficientCapacityException: no suitable host found")
+		},
+	}
+	s := scalerForScaleUpTest(cli, ScaleUpOptions{MaxConcurrency: 1, Retry: RetryPolicy{MaxAttempts: 1}})
+
+	vmp := baseVMProfile()
+	vmp.zoneIDs = []string{"zoneA", "zoneB"}
+
+	_, err := s.scaleUp(context.Background(), vmp, 1, nil)
+
+	require.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cli.deployCalls), "should have tried both zones before giving up")
+}
+
+// fakeJobResultClient is a scalerCloudstackClient whose QueryAsyncJobResult
+// always returns resp, for instanceStatus tests that only ever have one job
+// in flight at a time.
+type fakeJobResultClient struct {
+	resp  *cloudstack.QueryAsyncJobResultResponse
+	calls int32
+}
+
+func (f *fakeJobResultClient) QueryAsyncJobResult(*cloudstack.QueryAsyncJobResultParams) (*cloudstack.QueryAsyncJobResultResponse, error) {
+	atomic.AddInt32(&f.calls, 1)
+	return f.resp, nil
+}
+
+func (f *fakeJobResultClient) DestroyVirtualMachine(*cloudstack.DestroyVirtualMachineParams) (*cloudstack.DestroyVirtualMachineResponse, error) {
+	return nil, fmt.Errorf("unexpected DestroyVirtualMachine call")
+}
+
+func (f *fakeJobResultClient) DeployVirtualMachine(*cloudstack.DeployVirtualMachineParams) (*cloudstack.DeployVirtualMachineResponse, error) {
+	return nil, fmt.Errorf("unexpected DeployVirtualMachine call")
+}
+
+func (f *fakeJobResultClient) CreateTags(*cloudstack.CreateTagsParams) (*cloudstack.CreateTagsResponse, error) {
+	return nil, fmt.Errorf("unexpected CreateTags call")
+}
+
+func Test_csScaler_instanceStatus_running(t *testing.T) {
+	s := &csScaler{client: &fakeJobResultClient{}}
+	status := s.instanceStatus(&cloudstack.VirtualMachine{Id: "vm1", State: "Running"}, map[string]*cloudstack.QueryAsyncJobResultResponse{})
+	assert.Equal(t, cloudprovider.InstanceRunning, status.State)
+	assert.Nil(t, status.ErrorInfo)
+}
+
+func Test_csScaler_instanceStatus_creatingJobStillPending(t *testing.T) {
+	cli := &fakeJobResultClient{resp: &cloudstack.QueryAsyncJobResultResponse{Jobstatus: jobStatusPending}}
+	s := &csScaler{client: cli}
+	status := s.instanceStatus(&cloudstack.VirtualMachine{Id: "vm1", State: "Starting", Jobid: "job1"}, map[string]*cloudstack.QueryAsyncJobResultResponse{})
+	assert.Equal(t, cloudprovider.InstanceCreating, status.State)
+	assert.Nil(t, status.ErrorInfo)
+}
+
+func Test_csScaler_instanceStatus_outOfResources(t *testing.T) {
+	cli := &fakeJobResultClient{resp: &cloudstack.QueryAsyncJobResultResponse{
+		Jobstatus: jobStatusFailed,
+		Jobresult: []byte(`{"errorcode":431,"errortext":"no suitable host found"}`),
+	}}
+	s := &csScaler{client: cli}
+	status := s.instanceStatus(&cloudstack.VirtualMachine{Id: "vm1", State: "Starting", Jobid: "job1"}, map[string]*cloudstack.QueryAsyncJobResultResponse{})
+	require.NotNil(t, status.ErrorInfo)
+	assert.Equal(t, cloudprovider.OutOfResourcesErrorClass, status.ErrorInfo.ErrorClass)
+}
+
+func Test_csScaler_instanceStatus_deletingHeldBackUntilJobConfirms(t *testing.T) {
+	cli := &fakeJobResultClient{resp: &cloudstack.QueryAsyncJobResultResponse{Jobstatus: jobStatusPending}}
+	s := &csScaler{client: cli}
+	status := s.instanceStatus(&cloudstack.VirtualMachine{Id: "vm1", State: "Destroyed", Jobid: "job1"}, map[string]*cloudstack.QueryAsyncJobResultResponse{})
+	assert.Equal(t, cloudprovider.InstanceRunning, status.State, "destruction isn't confirmed by the job yet")
+}
+
+func Test_csScaler_instanceStatus_deletingConfirmedByJob(t *testing.T) {
+	cli := &fakeJobResultClient{resp: &cloudstack.QueryAsyncJobResultResponse{Jobstatus: jobStatusSuccess}}
+	s := &csScaler{client: cli}
+	status := s.instanceStatus(&cloudstack.VirtualMachine{Id: "vm1", State: "Destroyed", Jobid: "job1"}, map[string]*cloudstack.QueryAsyncJobResultResponse{})
+	assert.Equal(t, cloudprovider.InstanceDeleting, status.State)
+}
+
+func Test_csScaler_instanceStatus_deletingWithNoJobTracked(t *testing.T) {
+	s := &csScaler{client: &fakeJobResultClient{}}
+	status := s.instanceStatus(&cloudstack.VirtualMachine{Id: "vm1", State: "Stopped"}, map[string]*cloudstack.QueryAsyncJobResultResponse{})
+	assert.Equal(t, cloudprovider.InstanceDeleting, status.State)
+}
+
+func Test_csScaler_instanceStatus_unexpectedState(t *testing.T) {
+	s := &csScaler{client: &fakeJobResultClient{}}
+	status := s.instanceStatus(&cloudstack.VirtualMachine{Id: "vm1", State: "Unknown"}, map[string]*cloudstack.QueryAsyncJobResultResponse{})
+	require.NotNil(t, status.ErrorInfo)
+	assert.Equal(t, cloudprovider.OtherErrorClass, status.ErrorInfo.ErrorClass)
+}
+
+func Test_csScaler_instanceStatus_jobCacheAvoidsDuplicateQueries(t *testing.T) {
+	cli := &fakeJobResultClient{resp: &cloudstack.QueryAsyncJobResultResponse{Jobstatus: jobStatusSuccess}}
+	s := &csScaler{client: cli}
+	jobCache := map[string]*cloudstack.QueryAsyncJobResultResponse{}
+	s.instanceStatus(&cloudstack.VirtualMachine{Id: "vm1", State: "Destroyed", Jobid: "job1"}, jobCache)
+	s.instanceStatus(&cloudstack.VirtualMachine{Id: "vm2", State: "Destroyed", Jobid: "job1"}, jobCache)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cli.calls), "the second VM shares vm1's job and should hit the cache")
+}
+
+// Test_setOtherParams_golden pins setOtherParams' reflection-driven
+// dispatch against every key it used to support via a hand-written
+// switch, so replacing the switch with a registry couldn't silently
+// change behavior for any of them.
+func Test_setOtherParams_golden(t *testing.T) {
+	values := url.Values{
+		"account":            {"acct1"},
+		"affinitygroupids":   {"ag1,ag2"},
+		"affinitygroupnames": {"agn1,agn2"},
+		"diskofferingid":     {"disk1"},
+		"displayname":        {"display1"},
+		"hypervisor":         {"KVM"},
+		"keyboard":           {"us"},
+		"keypair":            {"kp1"},
+		"networkids":         {"net1,net2"},
+		"rootdisksize":       {"100"},
+		"securitygroupids":   {"sg1,sg2"},
+		"securitygroupnames": {"sgn1,sgn2"},
+		"size":               {"5"},
+		"userdata":           {"dXNlcmRhdGE="},
+	}
+
+	var got cloudstack.DeployVirtualMachineParams
+	setOtherParams(values, &got)
+
+	var want cloudstack.DeployVirtualMachineParams
+	want.SetAccount("acct1")
+	want.SetAffinitygroupids([]string{"ag1", "ag2"})
+	want.SetAffinitygroupnames([]string{"agn1", "agn2"})
+	want.SetDiskofferingid("disk1")
+	want.SetDisplayname("display1")
+	want.SetHypervisor("KVM")
+	want.SetKeyboard("us")
+	want.SetKeypair("kp1")
+	want.SetNetworkids([]string{"net1", "net2"})
+	want.SetRootdisksize(100)
+	want.SetSecuritygroupids([]string{"sg1", "sg2"})
+	want.SetSecuritygroupnames([]string{"sgn1", "sgn2"})
+	want.SetSize(5)
+	want.SetUserdata("dXNlcmRhdGE=")
+
+	assert.Equal(t, want, got)
+}
+
+// Test_setOtherParams_newSetterViaReflection checks that a setter added to
+// go-cloudstack after this file was last hand-edited - dhcpoptionsnetworklist
+// didn't exist in the original whitelist - is usable without a code change,
+// including its map[string]string encoding.
+func Test_setOtherParams_newSetterViaReflection(t *testing.T) {
+	values := url.Values{"dhcpoptionsnetworklist": {"net1=dhcp1,net2=dhcp2"}}
+
+	var got cloudstack.DeployVirtualMachineParams
+	setOtherParams(values, &got)
+
+	var want cloudstack.DeployVirtualMachineParams
+	want.SetDhcpoptionsnetworklist(map[string]string{"net1": "dhcp1", "net2": "dhcp2"})
+
+	assert.Equal(t, want, got)
+}
+
+func Test_setOtherParams_unknownKeyIgnored(t *testing.T) {
+	values := url.Values{"notarealsetter": {"x"}}
+
+	var got cloudstack.DeployVirtualMachineParams
+	setOtherParams(values, &got)
+
+	assert.Equal(t, cloudstack.DeployVirtualMachineParams{}, got)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// userdataHTTPClient fetches http(s):// userdata sources. A fixed timeout
+// keeps one slow or unreachable endpoint from blocking a VM's whole deploy
+// (see ScaleUpOptions.PerCallTimeout).
+var userdataHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// userdataTemplateContext is what {{ }} expansion in a node group's userdata
+// can reference. See (*csScaler).renderUserdata.
+type userdataTemplateContext struct {
+	NodeName string
+
+	// ProviderID is always empty: CloudStack only assigns a VM's ID once the
+	// very deploy job this userdata is attached to completes, so it can't be
+	// known yet when the template is expanded. It's kept in the context
+	// (rather than omitted) so a template referencing {{.ProviderID}} still
+	// parses and expands to "" instead of failing the deploy outright -
+	// operators needing the real ID still have to fall back to post-boot
+	// reconciliation for that one field.
+	ProviderID string
+
+	Zone      string
+	ProjectID string
+	Tags      map[string]string
+	Labels    map[string]string
+}
+
+// renderUserdata resolves vmp's userdata metadata, if set, into the payload
+// to deploy nodeName with: first following a configmap://, secret:// or
+// http(s):// indirection if the metadata value points to one (see
+// resolveUserdataSource), then expanding the result as a text/template so
+// operators can inject the new node's identity into their cloud-init script
+// instead of relying on post-boot reconciliation. The returned bool matches
+// vmProfile.userdata's own (value, isSet) shape.
+func (s *csScaler) renderUserdata(vmp vmProfile, nodeName string) (string, bool, error) {
+	raw, isSet := vmp.userdata()
+	if !isSet {
+		return "", false, nil
+	}
+
+	source, err := s.resolveUserdataSource(raw)
+	if err != nil {
+		return "", false, fmt.Errorf("resolving userdata source: %w", err)
+	}
+
+	tmpl, err := template.New("userdata").Parse(source)
+	if err != nil {
+		return "", false, fmt.Errorf("parsing userdata template: %w", err)
+	}
+	var rendered strings.Builder
+	err = tmpl.Execute(&rendered, userdataTemplateContext{
+		NodeName:  nodeName,
+		Zone:      vmp.zone.Name,
+		ProjectID: vmp.projectID(),
+		Tags:      vmp.tags(),
+		Labels:    vmp.labels(),
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("expanding userdata template: %w", err)
+	}
+	return rendered.String(), true, nil
+}
+
+// resolveUserdataSource follows raw's configmap://namespace/name/key,
+// secret://namespace/name/key or http(s):// indirection and returns the
+// payload it points to, memoized by raw in s.userdataCache so a node group
+// deploying many VMs at once doesn't refetch the same source per VM. raw is
+// returned unchanged if it isn't one of those schemes - a literal inline
+// template, the way userdata has always been set.
+func (s *csScaler) resolveUserdataSource(raw string) (string, error) {
+	if !strings.Contains(raw, "://") {
+		return raw, nil
+	}
+
+	s.userdataCacheMu.Lock()
+	cached, ok := s.userdataCache[raw]
+	s.userdataCacheMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	content, err := s.fetchUserdataSource(raw)
+	if err != nil {
+		return "", err
+	}
+
+	s.userdataCacheMu.Lock()
+	if s.userdataCache == nil {
+		s.userdataCache = map[string]string{}
+	}
+	s.userdataCache[raw] = content
+	s.userdataCacheMu.Unlock()
+	return content, nil
+}
+
+func (s *csScaler) fetchUserdataSource(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, "configmap://"):
+		return s.fetchUserdataFromKube(raw, "configmap://", func(kubeClient kubernetes.Interface, namespace, name string) (map[string]string, error) {
+			cm, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return cm.Data, nil
+		})
+	case strings.HasPrefix(raw, "secret://"):
+		return s.fetchUserdataFromKube(raw, "secret://", func(kubeClient kubernetes.Interface, namespace, name string) (map[string]string, error) {
+			secret, err := kubeClient.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			data := make(map[string]string, len(secret.Data))
+			for k, v := range secret.Data {
+				data[k] = string(v)
+			}
+			return data, nil
+		})
+	case strings.HasPrefix(raw, "http://"), strings.HasPrefix(raw, "https://"):
+		resp, err := userdataHTTPClient.Get(raw)
+		if err != nil {
+			return "", fmt.Errorf("fetching userdata from %q: %w", raw, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("fetching userdata from %q: unexpected status %s", raw, resp.Status)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("reading userdata from %q: %w", raw, err)
+		}
+		return string(body), nil
+	default:
+		return raw, nil
+	}
+}
+
+// fetchUserdataFromKube parses a configmap://namespace/name/key or
+// secret://namespace/name/key URI, fetches the referenced object via get,
+// and returns the value of its key.
+func (s *csScaler) fetchUserdataFromKube(raw, scheme string, get func(kubeClient kubernetes.Interface, namespace, name string) (map[string]string, error)) (string, error) {
+	kubeClient, err := s.getKubeClient()
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(strings.TrimPrefix(raw, scheme), "/", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed userdata source %q: want %snamespace/name/key", raw, scheme)
+	}
+	namespace, name, key := parts[0], parts[1], parts[2]
+	data, err := get(kubeClient, namespace, name)
+	if err != nil {
+		return "", fmt.Errorf("fetching userdata from %q: %w", raw, err)
+	}
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("userdata source %q: key %q not found", raw, key)
+	}
+	return value, nil
+}
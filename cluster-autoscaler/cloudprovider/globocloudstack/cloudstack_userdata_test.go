@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_csScaler_renderUserdata_notSet(t *testing.T) {
+	p := baseVMProfile()
+	delete(p.aspMetadata, autoScaleProfileMetadataUserdata)
+
+	s := &csScaler{}
+	userdata, isSet, err := s.renderUserdata(p, "node1")
+	require.NoError(t, err)
+	assert.False(t, isSet)
+	assert.Empty(t, userdata)
+}
+
+func Test_csScaler_renderUserdata_expandsVariables(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataUserdata] = "node={{.NodeName}} providerid={{.ProviderID}} zone={{.Zone}} project={{.ProjectID}} team={{.Tags.team}} pool={{.Labels.pool}}"
+	p.zone.Name = "zone1-name"
+
+	s := &csScaler{}
+	userdata, isSet, err := s.renderUserdata(p, "node1")
+	require.NoError(t, err)
+	assert.True(t, isSet)
+	assert.Equal(t, "node=node1 providerid= zone=zone1-name project= team=infra pool=workers", userdata)
+}
+
+func Test_csScaler_renderUserdata_invalidTemplate(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataUserdata] = "{{.Nope"
+
+	s := &csScaler{}
+	_, _, err := s.renderUserdata(p, "node1")
+	assert.Error(t, err)
+}
+
+func Test_csScaler_resolveUserdataSource_literalPassesThrough(t *testing.T) {
+	s := &csScaler{}
+	got, err := s.resolveUserdataSource("#!/bin/sh\necho hi")
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho hi", got)
+}
+
+func Test_csScaler_resolveUserdataSource_configmap(t *testing.T) {
+	cm := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "bootstrap", Namespace: "kube-system"},
+		Data:       map[string]string{"cloud-init": "#!/bin/sh\necho from-configmap"},
+	}
+	s := &csScaler{kubeClient: fake.NewSimpleClientset(cm)}
+
+	got, err := s.resolveUserdataSource("configmap://kube-system/bootstrap/cloud-init")
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho from-configmap", got)
+}
+
+func Test_csScaler_resolveUserdataSource_configmapKeyNotFound(t *testing.T) {
+	cm := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "bootstrap", Namespace: "kube-system"},
+		Data:       map[string]string{"other-key": "x"},
+	}
+	s := &csScaler{kubeClient: fake.NewSimpleClientset(cm)}
+
+	_, err := s.resolveUserdataSource("configmap://kube-system/bootstrap/cloud-init")
+	assert.Error(t, err)
+}
+
+func Test_csScaler_resolveUserdataSource_secret(t *testing.T) {
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "bootstrap", Namespace: "kube-system"},
+		Data:       map[string][]byte{"cloud-init": []byte("#!/bin/sh\necho from-secret")},
+	}
+	s := &csScaler{kubeClient: fake.NewSimpleClientset(secret)}
+
+	got, err := s.resolveUserdataSource("secret://kube-system/bootstrap/cloud-init")
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho from-secret", got)
+}
+
+func Test_csScaler_resolveUserdataSource_http(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#!/bin/sh\necho from-http"))
+	}))
+	defer srv.Close()
+
+	s := &csScaler{}
+	got, err := s.resolveUserdataSource(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho from-http", got)
+}
+
+func Test_csScaler_resolveUserdataSource_httpIsCached(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("cached"))
+	}))
+	defer srv.Close()
+
+	s := &csScaler{}
+	_, err := s.resolveUserdataSource(srv.URL)
+	require.NoError(t, err)
+	_, err = s.resolveUserdataSource(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func Test_csScaler_resolveUserdataSource_malformedKubeSource(t *testing.T) {
+	s := &csScaler{kubeClient: fake.NewSimpleClientset()}
+	_, err := s.resolveUserdataSource("configmap://just-a-name")
+	assert.Error(t, err)
+}
@@ -0,0 +1,437 @@
+package globocloudstack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+)
+
+type vmProfile struct {
+	asp         cloudstack.AutoScaleVmProfile
+	aspMetadata map[string]string
+	offering    cloudstack.ServiceOffering
+	zone        cloudstack.Zone
+
+	// zoneIDs is the resolved form of the cluster-autoscaler/zones metadata
+	// (see zoneNames), filled in by cloudstackManager.resolveNodeGroupZones.
+	// Empty for a single-zone profile - deployZoneIDs falls back to asp.Zoneid.
+	zoneIDs []string
+}
+
+func (p *vmProfile) Id() string {
+	if p.aspMetadata == nil {
+		return ""
+	}
+	return p.aspMetadata[autoScaleProfileMetadataName]
+}
+
+func (p *vmProfile) maxSize() int {
+	if p.aspMetadata == nil {
+		return 0
+	}
+	max, _ := strconv.Atoi(p.aspMetadata[autoScaleProfileMetadataMax])
+	return max
+}
+
+func (p *vmProfile) minSize() int {
+	if p.aspMetadata == nil {
+		return 0
+	}
+	min, _ := strconv.Atoi(p.aspMetadata[autoScaleProfileMetadataMin])
+	return min
+}
+
+func (p *vmProfile) userdata() (string, bool) {
+	if p.aspMetadata == nil {
+		return "", false
+	}
+	v, ok := p.aspMetadata[autoScaleProfileMetadataUserdata]
+	return v, ok
+}
+
+func (p *vmProfile) providerIDPrefix() string {
+	if p.aspMetadata == nil {
+		return ""
+	}
+	return p.aspMetadata[autoScaleProfileMetadataProviderIDPrefix]
+}
+
+func (p *vmProfile) autoprovisioned() bool {
+	if p.aspMetadata == nil {
+		return false
+	}
+	return p.aspMetadata[autoScaleProfileMetadataAutoprovisioned] == "true"
+}
+
+// managedExternallyBy returns the controller that owns this node group's VM
+// lifecycle instead of cloudstackManager (e.g. managedExternallyByCAPI), or
+// "" for a node group cloudstackManager scales directly. See
+// autoScaleProfileMetadataManagedExternallyBy.
+func (p *vmProfile) managedExternallyBy() string {
+	if p.aspMetadata == nil {
+		return ""
+	}
+	return p.aspMetadata[autoScaleProfileMetadataManagedExternallyBy]
+}
+
+func (p *vmProfile) projectID() string {
+	if p.asp.Projectid != "" {
+		return p.asp.Projectid
+	}
+	// Some cloudstack distributions won't allow creating an AutoScaleProfile
+	// with a projectID. This is why we fallback to reading the projectID from
+	// the OtherDeployParams field.
+	if values, err := url.ParseQuery(p.asp.Otherdeployparams); err == nil {
+		return values.Get("projectid")
+	}
+	return ""
+}
+
+// zoneNames returns the ordered list of zone names from the
+// cluster-autoscaler/zones metadata key (see
+// autoScaleProfileMetadataZones), for a node group that wants to fail over
+// to another zone when its primary one is out of capacity. Empty if unset -
+// the node group then keeps using its single asp.Zoneid, exactly as before
+// multi-zone support existed.
+func (p *vmProfile) zoneNames() []string {
+	if p.aspMetadata == nil {
+		return nil
+	}
+	raw := p.aspMetadata[autoScaleProfileMetadataZones]
+	if raw == "" {
+		return nil
+	}
+	return strings.Split(raw, ",")
+}
+
+// deployZoneIDs returns the ordered list of zone IDs csScaler.createVMAcrossZones
+// should try a new VM in. A profile resolved from cluster-autoscaler/zones
+// metadata (see zoneNames) returns that priority order; otherwise it falls
+// back to the single asp.Zoneid, so a VM is always deployed into exactly
+// the zones the profile would have used before multi-zone support existed.
+func (p *vmProfile) deployZoneIDs() []string {
+	if len(p.zoneIDs) > 0 {
+		return p.zoneIDs
+	}
+	return []string{p.asp.Zoneid}
+}
+
+func (p *vmProfile) rootDiskSize() int64 {
+	if values, err := url.ParseQuery(p.asp.Otherdeployparams); err == nil {
+		raw := values.Get("rootdisksize")
+		size, _ := strconv.ParseInt(raw, 10, 64)
+		return size
+	}
+	return 0
+}
+
+// otherDeployParam reads a single key out of Otherdeployparams, same as
+// projectID/rootDiskSize do for their own keys. An unparseable or absent
+// Otherdeployparams yields "".
+func (p *vmProfile) otherDeployParam(key string) string {
+	values, err := url.ParseQuery(p.asp.Otherdeployparams)
+	if err != nil {
+		return ""
+	}
+	return values.Get(key)
+}
+
+// otherDeployParamList reads a comma-separated key out of Otherdeployparams,
+// the same encoding setOtherParams uses for a []string setter like
+// SetAffinitygroupids. A missing key yields nil, not []string{""}.
+func (p *vmProfile) otherDeployParamList(key string) []string {
+	raw := p.otherDeployParam(key)
+	if raw == "" {
+		return nil
+	}
+	return strings.Split(raw, ",")
+}
+
+// affinityGroupIDs, keypair, securityGroupIDs, networkIDs and
+// additionalDiskOfferingID expose the same Otherdeployparams keys
+// setOtherParams already threads into DeployVirtualMachineParams generically
+// (see createDeployVMParams), as typed values for callers that need to read
+// them back rather than just pass them through - e.g. debugging output or a
+// future driftCategory.
+func (p *vmProfile) affinityGroupIDs() []string {
+	return p.otherDeployParamList("affinitygroupids")
+}
+
+func (p *vmProfile) keypair() string {
+	return p.otherDeployParam("keypair")
+}
+
+func (p *vmProfile) securityGroupIDs() []string {
+	return p.otherDeployParamList("securitygroupids")
+}
+
+func (p *vmProfile) networkIDs() []string {
+	return p.otherDeployParamList("networkids")
+}
+
+func (p *vmProfile) additionalDiskOfferingID() string {
+	return p.otherDeployParam("diskofferingid")
+}
+
+// ipToNetworkList parses per-NIC network/IP assignments out of
+// Otherdeployparams, in the indexed query-string form CloudStack's API uses
+// for deployVirtualMachine's iptonetworklist parameter - e.g.
+// "iptonetworklist[0].networkid=net1&iptonetworklist[0].ipv4=10.0.0.5&iptonetworklist[1].networkid=net2".
+// Unlike the keys above, this one can't be picked up by setOtherParams' flat
+// key/setter reflection (see otherParamSetters), since it's an indexed list
+// of sub-fields rather than a single scalar, []string or map[string]string
+// value - so createDeployVMParams threads it through explicitly instead.
+// Entries are returned in ascending index order; an entry missing networkid
+// is dropped, since CloudStack requires one per NIC.
+func (p *vmProfile) ipToNetworkList() []map[string]string {
+	values, err := url.ParseQuery(p.asp.Otherdeployparams)
+	if err != nil {
+		return nil
+	}
+
+	type ipToNetwork struct {
+		networkID, ipv4, ipv6 string
+	}
+	byIndex := map[int]*ipToNetwork{}
+	for key := range values {
+		prefix, field, ok := strings.Cut(key, ".")
+		if !ok {
+			continue
+		}
+		idxStr := strings.TrimSuffix(strings.TrimPrefix(prefix, "iptonetworklist["), "]")
+		if idxStr == prefix {
+			continue
+		}
+		idx, err := strconv.Atoi(idxStr)
+		if err != nil {
+			continue
+		}
+		n, ok := byIndex[idx]
+		if !ok {
+			n = &ipToNetwork{}
+			byIndex[idx] = n
+		}
+		switch field {
+		case "networkid":
+			n.networkID = values.Get(key)
+		case "ipv4":
+			n.ipv4 = values.Get(key)
+		case "ipv6":
+			n.ipv6 = values.Get(key)
+		}
+	}
+	if len(byIndex) == 0 {
+		return nil
+	}
+
+	indices := make([]int, 0, len(byIndex))
+	for idx := range byIndex {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+
+	list := make([]map[string]string, 0, len(indices))
+	for _, idx := range indices {
+		n := byIndex[idx]
+		if n.networkID == "" {
+			continue
+		}
+		entry := map[string]string{"networkid": n.networkID}
+		if n.ipv4 != "" {
+			entry["ip"] = n.ipv4
+		}
+		if n.ipv6 != "" {
+			entry["ip6"] = n.ipv6
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// otherDeployParamsMap parses an OtherDeployParams query string into a
+// plain key/value map, so callers (driftCategories' OtherDeployParamsDrift
+// hash) can diff it by content instead of by its raw, order-sensitive
+// string form. An unparseable string yields an empty map.
+func otherDeployParamsMap(otherDeployParams string) map[string]string {
+	values, err := url.ParseQuery(otherDeployParams)
+	if err != nil {
+		return map[string]string{}
+	}
+	m := make(map[string]string, len(values))
+	for k := range values {
+		m[k] = values.Get(k)
+	}
+	return m
+}
+
+func (p *vmProfile) tags() map[string]string {
+	return p.toMap(autoScaleProfileMetadataVMTagPrefix)
+}
+
+func (p *vmProfile) labels() map[string]string {
+	return p.toMap(autoScaleProfileMetadataNodeLabelPrefix)
+}
+
+// driftCategory is one independently fingerprinted slice of an
+// AutoScaleVmProfile. csScaler stamps one tag per category on every VM it
+// creates (see createVMTagsParams), so detectDrift can later compare a VM's
+// stamped tags against the node group's current profile and attribute a
+// mismatch to a specific, stable reason code instead of just "the profile
+// changed somehow".
+type driftCategory struct {
+	tag    string
+	reason string
+	hash   func(p *vmProfile) string
+}
+
+// driftCategories lists every category detectDrift checks, in priority
+// order: when a VM has drifted in more than one category at once, the
+// first match in this slice wins, so the reported reason is deterministic.
+var driftCategories = []driftCategory{
+	{
+		tag:    nodeGroupOfferingHashTag,
+		reason: "ServiceOfferingDrift",
+		hash:   func(p *vmProfile) string { return shortHash(p.asp.Serviceofferingid) },
+	},
+	{
+		tag:    nodeGroupTemplateHashTag,
+		reason: "TemplateDrift",
+		hash:   func(p *vmProfile) string { return shortHash(p.asp.Templateid) },
+	},
+	{
+		tag:    nodeGroupZoneHashTag,
+		reason: "ZoneDrift",
+		hash:   func(p *vmProfile) string { return shortHash(p.asp.Zoneid) },
+	},
+	{
+		tag:    nodeGroupDeployParamsHashTag,
+		reason: "OtherDeployParamsDrift",
+		// Otherdeployparams is parsed into a key/value map (as scaleUp
+		// already does for individual keys like networkids/rootdisksize)
+		// and fingerprinted via mapFingerprint, rather than hashed as a raw
+		// query string, so two ASPs with the same params in a different
+		// order don't falsely drift against each other.
+		hash: func(p *vmProfile) string {
+			return shortHash(mapFingerprint(otherDeployParamsMap(p.asp.Otherdeployparams)))
+		},
+	},
+	{
+		tag:    nodeGroupUserDataHashTag,
+		reason: "UserDataDrift",
+		hash: func(p *vmProfile) string {
+			userdata, _ := p.userdata()
+			return shortHash(userdata)
+		},
+	},
+	{
+		tag:    nodeGroupTagsHashTag,
+		reason: "TagsDrift",
+		hash:   func(p *vmProfile) string { return shortHash(mapFingerprint(p.labels()) + mapFingerprint(p.tags())) },
+	},
+}
+
+// driftHash combines every driftCategory's fingerprint into the single
+// overall hash stamped in nodeGroupProfileHashTag, so detectDrift can tell
+// whether a VM has drifted at all with one tag comparison, without needing
+// to check every category on every VM on every Refresh.
+func (p *vmProfile) driftHash() string {
+	h := sha256.New()
+	for _, c := range driftCategories {
+		fmt.Fprintf(h, "%s=%s\n", c.tag, c.hash(p))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func (p *vmProfile) toMap(prefix string) map[string]string {
+	m := map[string]string{}
+	for key, value := range p.aspMetadata {
+		if strings.HasPrefix(key, prefix) {
+			m[strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+	return m
+}
+
+// mapFingerprint deterministically renders a string map for hashing,
+// regardless of map iteration order.
+func mapFingerprint(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, m[k])
+	}
+	return b.String()
+}
+
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// NodeGroupShapeTemplate is the admin-configured template
+// cloudstackManager.createProfile provisions an AutoScaleVmProfile from, for
+// a node group name with no existing AutoScaleVmProfile backing it yet. See
+// csConfig.NodeGroupShapeTemplates.
+type NodeGroupShapeTemplate struct {
+	// ServiceOfferingID, TemplateID and ZoneID are the CloudStack ids the
+	// created AutoScaleVmProfile deploys VMs with.
+	ServiceOfferingID string `json:"service_offering_id"`
+	TemplateID        string `json:"template_id"`
+	ZoneID            string `json:"zone_id"`
+
+	// OtherDeployParams is passed straight through to the created
+	// AutoScaleVmProfile's Otherdeployparams, same as a discovered ASP's.
+	OtherDeployParams string `json:"other_deploy_params"`
+
+	// MinSize and MaxSize become the node group's minNodes/maxNodes
+	// metadata.
+	MinSize int `json:"min_size"`
+	MaxSize int `json:"max_size"`
+
+	// Userdata, Labels and Tags become the node group's userdata/label-*/
+	// tag-* metadata, same as a discovered ASP's.
+	Userdata string            `json:"userdata"`
+	Labels   map[string]string `json:"labels"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// vmProfile converts t into the vmProfile cloudstackManager.createProfile
+// expects, stamping name into aspMetadata exactly like Refresh does for a
+// discovered AutoScaleVmProfile.
+func (t NodeGroupShapeTemplate) vmProfile(name string) vmProfile {
+	metadata := map[string]string{
+		autoScaleProfileMetadataName: name,
+		autoScaleProfileMetadataMin:  strconv.Itoa(t.MinSize),
+		autoScaleProfileMetadataMax:  strconv.Itoa(t.MaxSize),
+	}
+	if t.Userdata != "" {
+		metadata[autoScaleProfileMetadataUserdata] = t.Userdata
+	}
+	for k, v := range t.Labels {
+		metadata[autoScaleProfileMetadataNodeLabelPrefix+k] = v
+	}
+	for k, v := range t.Tags {
+		metadata[autoScaleProfileMetadataVMTagPrefix+k] = v
+	}
+
+	return vmProfile{
+		asp: cloudstack.AutoScaleVmProfile{
+			Serviceofferingid: t.ServiceOfferingID,
+			Templateid:        t.TemplateID,
+			Zoneid:            t.ZoneID,
+			Otherdeployparams: t.OtherDeployParams,
+		},
+		aspMetadata: metadata,
+	}
+}
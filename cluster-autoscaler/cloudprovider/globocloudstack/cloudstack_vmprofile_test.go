@@ -0,0 +1,147 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package globocloudstack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+)
+
+func baseVMProfile() vmProfile {
+	return vmProfile{
+		asp: cloudstack.AutoScaleVmProfile{
+			Serviceofferingid: "offering1",
+			Templateid:        "template1",
+			Zoneid:            "zone1",
+		},
+		aspMetadata: map[string]string{
+			autoScaleProfileMetadataUserdata:                 "#!/bin/sh",
+			autoScaleProfileMetadataNodeLabelPrefix + "pool": "workers",
+			autoScaleProfileMetadataVMTagPrefix + "team":     "infra",
+		},
+	}
+}
+
+func Test_vmProfile_driftHash_stableForEqualProfiles(t *testing.T) {
+	p1 := baseVMProfile()
+	p2 := baseVMProfile()
+	assert.Equal(t, p1.driftHash(), p2.driftHash())
+}
+
+func Test_vmProfile_driftHash_changesWithTrackedFields(t *testing.T) {
+	tests := map[string]func(p *vmProfile){
+		"serviceofferingid": func(p *vmProfile) { p.asp.Serviceofferingid = "offering2" },
+		"templateid":        func(p *vmProfile) { p.asp.Templateid = "template2" },
+		"zoneid":            func(p *vmProfile) { p.asp.Zoneid = "zone2" },
+		"otherdeployparams": func(p *vmProfile) { p.asp.Otherdeployparams = "account=acct1" },
+		"userdata":          func(p *vmProfile) { p.aspMetadata[autoScaleProfileMetadataUserdata] = "#!/bin/sh\necho hi" },
+		"label":             func(p *vmProfile) { p.aspMetadata[autoScaleProfileMetadataNodeLabelPrefix+"pool"] = "gpu" },
+		"tag":               func(p *vmProfile) { p.aspMetadata[autoScaleProfileMetadataVMTagPrefix+"team"] = "platform" },
+	}
+
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			before := baseVMProfile()
+			after := baseVMProfile()
+			mutate(&after)
+			assert.NotEqual(t, before.driftHash(), after.driftHash())
+		})
+	}
+}
+
+func Test_vmProfile_driftHash_unaffectedByUntrackedMetadata(t *testing.T) {
+	before := baseVMProfile()
+	after := baseVMProfile()
+	after.aspMetadata[autoScaleProfileMetadataName] = "some-other-name"
+	assert.Equal(t, before.driftHash(), after.driftHash())
+}
+
+func Test_vmProfile_driftHash_unaffectedByOtherDeployParamsOrdering(t *testing.T) {
+	before := baseVMProfile()
+	before.asp.Otherdeployparams = "account=acct1&rootdisksize=100"
+	after := baseVMProfile()
+	after.asp.Otherdeployparams = "rootdisksize=100&account=acct1"
+	assert.Equal(t, before.driftHash(), after.driftHash())
+}
+
+func Test_vmProfile_otherDeployParamAccessors(t *testing.T) {
+	p := baseVMProfile()
+	p.asp.Otherdeployparams = "affinitygroupids=ag1,ag2&keypair=kp1&securitygroupids=sg1,sg2&networkids=net1,net2&diskofferingid=disk1"
+
+	assert.Equal(t, []string{"ag1", "ag2"}, p.affinityGroupIDs())
+	assert.Equal(t, "kp1", p.keypair())
+	assert.Equal(t, []string{"sg1", "sg2"}, p.securityGroupIDs())
+	assert.Equal(t, []string{"net1", "net2"}, p.networkIDs())
+	assert.Equal(t, "disk1", p.additionalDiskOfferingID())
+}
+
+func Test_vmProfile_otherDeployParamAccessors_absent(t *testing.T) {
+	p := baseVMProfile()
+
+	assert.Nil(t, p.affinityGroupIDs())
+	assert.Equal(t, "", p.keypair())
+	assert.Nil(t, p.securityGroupIDs())
+	assert.Nil(t, p.networkIDs())
+	assert.Equal(t, "", p.additionalDiskOfferingID())
+}
+
+func Test_vmProfile_ipToNetworkList(t *testing.T) {
+	p := baseVMProfile()
+	p.asp.Otherdeployparams = "iptonetworklist[1].networkid=net2&iptonetworklist[1].ipv4=10.0.0.2" +
+		"&iptonetworklist[0].networkid=net1&iptonetworklist[0].ipv4=10.0.0.1&iptonetworklist[0].ipv6=fd00::1"
+
+	assert.Equal(t, []map[string]string{
+		{"networkid": "net1", "ip": "10.0.0.1", "ip6": "fd00::1"},
+		{"networkid": "net2", "ip": "10.0.0.2"},
+	}, p.ipToNetworkList())
+}
+
+func Test_vmProfile_ipToNetworkList_dropsEntryMissingNetworkID(t *testing.T) {
+	p := baseVMProfile()
+	p.asp.Otherdeployparams = "iptonetworklist[0].ipv4=10.0.0.1"
+
+	assert.Empty(t, p.ipToNetworkList())
+}
+
+func Test_vmProfile_ipToNetworkList_absent(t *testing.T) {
+	p := baseVMProfile()
+	assert.Nil(t, p.ipToNetworkList())
+}
+
+func Test_vmProfile_zoneNames(t *testing.T) {
+	p := baseVMProfile()
+	p.aspMetadata[autoScaleProfileMetadataZones] = "zone-a,zone-b,zone-c"
+	assert.Equal(t, []string{"zone-a", "zone-b", "zone-c"}, p.zoneNames())
+}
+
+func Test_vmProfile_zoneNames_absent(t *testing.T) {
+	p := baseVMProfile()
+	assert.Nil(t, p.zoneNames())
+}
+
+func Test_vmProfile_deployZoneIDs_multiZone(t *testing.T) {
+	p := baseVMProfile()
+	p.zoneIDs = []string{"zoneA", "zoneB"}
+	assert.Equal(t, []string{"zoneA", "zoneB"}, p.deployZoneIDs())
+}
+
+func Test_vmProfile_deployZoneIDs_fallsBackToSingleZone(t *testing.T) {
+	p := baseVMProfile()
+	assert.Equal(t, []string{"zone1"}, p.deployZoneIDs())
+}